@@ -1,9 +1,24 @@
+// crypto-arbitrage tracks the premiums of local fiat crypto venues over the global reference and alerts on them.
+// It builds with Go 1.24 or newer, the keystore uses crypto/pbkdf2 and the logs log/slog. The dependencies are
+// vendored, vendor/vendor.json pins the Go version of the Heroku build.
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/yaso195/crypto-arbitrage/server"
 )
 
 func main() {
+	// "keystore <file>" encrypts the JSON object of secrets read from stdin with $SECRETS_KEYSTORE_PASSPHRASE.
+	if len(os.Args) == 3 && os.Args[1] == "keystore" {
+		if err := server.WriteKeystore(os.Args[2], os.Getenv("SECRETS_KEYSTORE_PASSPHRASE"), os.Stdin); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	server.Run()
 }
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ADAPTER_ENABLED       = "enabled"
+	ADAPTER_DISABLED      = "disabled"
+	ADAPTER_AUTO_DISABLED = "auto-disabled"
+
+	HEALTH_CHECK_INTERVAL = 1 * time.Minute
+	// MAX_ADAPTER_FAILURES consecutive failed polls or probes auto-disable an adapter.
+	MAX_ADAPTER_FAILURES = 5
+	// MAX_INVERTED_RESULTS consecutive results containing an inverted book auto-disable an adapter.
+	MAX_INVERTED_RESULTS = 3
+)
+
+// AdapterStatus is the state of a REST adapter as shown on the exchanges page.
+type AdapterStatus struct {
+	Name      string
+	State     string
+	Since     time.Time
+	Streamed  bool
+	Reference bool
+	// Failures and Inverted count consecutive bad results, a good result resets them.
+	Failures    int
+	Inverted    int
+	LastSuccess time.Time
+	LastProbe   time.Time
+	LastError   string
+}
+
+// adapter is a venue's REST price source. Enabled adapters are polled by calculatePrices, streamed ones only while
+// their stream is down. The health check probes the adapters that are not polled; an auto-disabled adapter is
+// enabled again by its first healthy probe while a manually disabled one is left alone until it is switched on.
+type adapter struct {
+	getPrices func() ([]Price, error)
+	publish   func(exchange string, list []Price, symbols []string, receivedTime time.Time)
+
+	mu     sync.Mutex
+	status AdapterStatus
+}
+
+var (
+	adapters   = map[string]*adapter{}
+	adapterMux sync.Mutex
+)
+
+func init() {
+	registerAdapter(BINANCE, getBinancePrices, true, true)
+	registerAdapter(BTCTURK, getBTCTurkPrices, true, true)
+	registerAdapter(PARIBU, getParibuPrices, true, true)
+	registerAdapter(KOINIM, getKoinimPrices, false, true)
+	registerAdapter(KOINEKS, getKoineksPrices, false, false)
+	registerAdapter(VEBITCOIN, getVebitcoinPrices, false, false)
+	registerAdapter(BITOASIS, getBitOasisPrices, false, true)
+	registerReferenceAdapter(KRAKEN, getKrakenPrices, true, true)
+	registerReferenceAdapter(BITSTAMP, getBitstampPrices, true, true)
+	registerReferenceAdapter(BITFINEX, getBitfinexPrices, false, true)
+	registerReferenceAdapter(BINANCE_USDT, getBinanceUSDTPrices, false, true)
+
+	// ENABLED_EXCHANGES and DISABLED_EXCHANGES override the defaults with comma separated exchange names.
+	for _, name := range strings.Split(os.Getenv("ENABLED_EXCHANGES"), ",") {
+		setAdapterEnabled(strings.TrimSpace(name), true)
+	}
+	for _, name := range strings.Split(os.Getenv("DISABLED_EXCHANGES"), ",") {
+		setAdapterEnabled(strings.TrimSpace(name), false)
+	}
+}
+
+func registerAdapter(name string, getPrices func() ([]Price, error), streamed, enabled bool) {
+	addAdapter(newAdapter(name, getPrices, streamed, enabled))
+}
+
+// registerReferenceAdapter registers a USD or EUR venue whose quotes feed the composite reference instead of the
+// premiums.
+func registerReferenceAdapter(name string, getPrices func() ([]Price, error), streamed, enabled bool) {
+	a := newAdapter(name, getPrices, streamed, enabled)
+	a.publish = publishReferenceQuotes
+	a.status.Reference = true
+	addAdapter(a)
+}
+
+func newAdapter(name string, getPrices func() ([]Price, error), streamed, enabled bool) *adapter {
+	state := ADAPTER_ENABLED
+	if !enabled {
+		state = ADAPTER_DISABLED
+	}
+
+	return &adapter{
+		getPrices: getPrices,
+		publish:   publishQuotes,
+		status:    AdapterStatus{Name: name, State: state, Since: clockNow(), Streamed: streamed},
+	}
+}
+
+func addAdapter(a *adapter) {
+	adapterMux.Lock()
+	adapters[a.status.Name] = a
+	adapterMux.Unlock()
+}
+
+func getAdapter(name string) (*adapter, bool) {
+	adapterMux.Lock()
+	defer adapterMux.Unlock()
+	a, ok := adapters[name]
+	return a, ok
+}
+
+func adapterStatuses() []AdapterStatus {
+	adapterMux.Lock()
+	defer adapterMux.Unlock()
+
+	var statuses []AdapterStatus
+	for _, a := range adapters {
+		statuses = append(statuses, a.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// adapterEnabled reports whether quotes of the exchange may be used. Exchanges without an adapter, such as the
+// reference, are always enabled.
+func adapterEnabled(name string) bool {
+	a, ok := getAdapter(name)
+	return !ok || a.Status().State == ADAPTER_ENABLED
+}
+
+// setAdapterEnabled switches an adapter on or off by hand. The quotes of a disabled venue are withdrawn at once.
+func setAdapterEnabled(name string, enabled bool) bool {
+	a, ok := getAdapter(name)
+	if !ok {
+		return false
+	}
+
+	state := ADAPTER_DISABLED
+	if enabled {
+		state = ADAPTER_ENABLED
+	}
+	a.setState(state, "")
+	return true
+}
+
+func (a *adapter) Status() AdapterStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.status
+}
+
+func (a *adapter) setState(state, reason string) {
+	a.mu.Lock()
+	changed := a.status.State != state
+	if changed {
+		a.status.State = state
+		a.status.Since = clockNow()
+		a.status.Failures, a.status.Inverted = 0, 0
+	}
+	name := a.status.Name
+	a.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if state == ADAPTER_ENABLED {
+		adapterLog.Info("adapter enabled", "exchange", name, "reason", reason)
+	} else {
+		adapterLog.Warn("adapter "+state, "exchange", name, "reason", reason)
+	}
+
+	if state != ADAPTER_ENABLED {
+		withdrawQuotes(name)
+	}
+}
+
+// observe records the outcome of a poll or probe and auto-disables or re-enables the adapter.
+func (a *adapter) observe(list []Price, err error, probe bool) {
+	a.mu.Lock()
+	now := clockNow()
+	if probe {
+		a.status.LastProbe = now
+	}
+
+	var inverted []string
+	for _, p := range list {
+		if p.Ask > 0 && p.Bid > 0 && p.Ask < p.Bid {
+			inverted = append(inverted, p.ID)
+		}
+	}
+	if err == nil && len(list) == 0 {
+		err = fmt.Errorf("no prices returned")
+	}
+
+	switch {
+	case err != nil:
+		a.status.Failures++
+		a.status.LastError = err.Error()
+	case len(inverted) > 0:
+		a.status.Failures = 0
+		a.status.Inverted++
+		a.status.LastError = fmt.Sprintf("inverted books : %s", strings.Join(inverted, ", "))
+	default:
+		a.status.Failures, a.status.Inverted = 0, 0
+		a.status.LastSuccess = now
+		a.status.LastError = ""
+	}
+	state, failures, invertedResults, lastError := a.status.State, a.status.Failures, a.status.Inverted, a.status.LastError
+	a.mu.Unlock()
+
+	switch {
+	case state == ADAPTER_ENABLED && failures >= MAX_ADAPTER_FAILURES:
+		a.setState(ADAPTER_AUTO_DISABLED, fmt.Sprintf("%d consecutive failures, last : %s", failures, lastError))
+	case state == ADAPTER_ENABLED && invertedResults >= MAX_INVERTED_RESULTS:
+		a.setState(ADAPTER_AUTO_DISABLED, fmt.Sprintf("%d consecutive results with %s", invertedResults, lastError))
+	case state == ADAPTER_AUTO_DISABLED && probe && failures == 0 && invertedResults == 0:
+		a.setState(ADAPTER_ENABLED, "health check passed")
+	}
+}
+
+// withdrawQuotes drops the quotes of a venue so they leave the diffs, the alerting and the dashboard.
+func withdrawQuotes(exchange string) {
+	market.update(func(next *marketSnapshot) {
+		delete(next.Quotes, exchange)
+		delete(next.ReferenceQuotes, exchange)
+	})
+	emitQuoteEvent(quoteEvent{Exchange: exchange, ReceivedTime: clockNow()})
+}
+
+// checkAdapters probes the auto-disabled adapters and the streamed ones whose stream is up. Enabled adapters that
+// are polled are already judged by their polls, a venue disabled by hand is not called at all.
+func checkAdapters(ctx context.Context) {
+	for sleepContext(ctx, HEALTH_CHECK_INTERVAL) {
+		var wg sync.WaitGroup
+		for _, status := range adapterStatuses() {
+			if status.State == ADAPTER_DISABLED {
+				continue
+			}
+			if status.State == ADAPTER_ENABLED && (!status.Streamed || !feedConnected(status.Name)) {
+				continue
+			}
+
+			a, _ := getAdapter(status.Name)
+			wg.Add(1)
+			go func(a *adapter) {
+				defer wg.Done()
+				list, err := a.getPrices()
+				if ctx.Err() == nil {
+					a.observe(list, err, true)
+				}
+			}(a)
+		}
+		wg.Wait()
+	}
+}
+
+func ListExchanges(c *gin.Context) {
+	c.HTML(http.StatusOK, "exchanges.tmpl", gin.H{
+		"Adapters": adapterStatuses(),
+		"Feeds":    feedStatuses(),
+		"Quality":  qualityStatuses(),
+		"User":     authUser(c),
+		"CSRF":     csrfToken(c),
+	})
+}
+
+func ToggleExchange(c *gin.Context) {
+	name := c.PostForm("name")
+	enabled := c.PostForm("enabled")
+	if enabled != "true" && enabled != "false" {
+		c.String(http.StatusBadRequest, fmt.Sprintf("invalid enabled value %q", enabled))
+		return
+	}
+
+	if !setAdapterEnabled(name, enabled == "true") {
+		c.String(http.StatusNotFound, fmt.Sprintf("unknown exchange %q", name))
+		return
+	}
+	audit(c, authUser(c), "exchange toggled", "exchange", name, "enabled", enabled)
+	c.Redirect(http.StatusSeeOther, "/exchanges")
+}
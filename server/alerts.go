@@ -0,0 +1,422 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ALERT_STATUS_SENT   = "sent"
+	ALERT_STATUS_FAILED = "failed"
+	// ALERT_STATUS_SUPPRESSED is a crossing that was not notified because its key was acknowledged or snoozed.
+	ALERT_STATUS_SUPPRESSED = "suppressed"
+
+	DEFAULT_ALERT_HISTORY_FILE = "alerts.json"
+	MAX_ALERT_HISTORY          = 5000
+	DEFAULT_SNOOZE_MINUTES     = 60.0
+	// ALERT_SAVE_DELAY is how long the history is left unsaved after a change, the changes made meanwhile are written
+	// together.
+	ALERT_SAVE_DELAY = time.Second
+)
+
+// Alert is a single fired notification together with the market values that triggered it.
+type Alert struct {
+	ID             int64   `json:"id"`
+	Key            string  `json:"key"`
+	Exchange       string  `json:"exchange"`
+	Symbol         string  `json:"symbol"`
+	Side           string  `json:"side"`
+	Diff           float64 `json:"diff"`
+	AskDiff        float64 `json:"askDiff"`
+	BidDiff        float64 `json:"bidDiff"`
+	Price          float64 `json:"price"`
+	ReferencePrice float64 `json:"referencePrice"`
+	// Reference is the reference the diffs were computed against, Coinbase Pro or the composite index.
+	Reference    string  `json:"reference,omitempty"`
+	Currency     string  `json:"currency,omitempty"`
+	Rate         float64 `json:"rate"`
+	Spread       float64 `json:"spread"`
+	MinThreshold float64 `json:"minThreshold"`
+	MaxThreshold float64 `json:"maxThreshold"`
+	Message      string  `json:"message"`
+	Status       string  `json:"status"`
+	// Escalated alerts were sent again at a high priority because nobody acknowledged them.
+	Escalated bool      `json:"escalated,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// AlertAck silences an alert key. An acknowledged key stays silent until its alert condition clears,
+// a snoozed key stays silent until SnoozedUntil.
+type AlertAck struct {
+	Key          string    `json:"key"`
+	Acknowledged bool      `json:"acknowledged"`
+	SnoozedUntil time.Time `json:"snoozedUntil"`
+	Time         time.Time `json:"time"`
+}
+
+type alertFilter struct {
+	Exchange string
+	Symbol   string
+	Status   string
+	Since    time.Time
+	Limit    int
+}
+
+type alertStore struct {
+	Alerts []Alert              `json:"alerts"`
+	Acks   map[string]*AlertAck `json:"acks"`
+	NextID int64                `json:"nextId"`
+}
+
+var (
+	alerts           = alertStore{Acks: map[string]*AlertAck{}, NextID: 1}
+	alertMux         sync.Mutex
+	alertHistoryFile = DEFAULT_ALERT_HISTORY_FILE
+
+	// alertHistoryChanged wakes persistAlertHistory, alertSaveMux keeps two saves from writing the file at once.
+	alertHistoryChanged = make(chan struct{}, 1)
+	alertSaveMux        sync.Mutex
+)
+
+func init() {
+	if file := os.Getenv("ALERT_HISTORY_FILE"); file != "" {
+		alertHistoryFile = file
+	}
+}
+
+func loadAlertHistory() error {
+	data, err := ioutil.ReadFile(alertHistoryFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read alert history %s : %s", alertHistoryFile, err)
+	}
+
+	stored := alertStore{}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("failed to parse alert history %s : %s", alertHistoryFile, err)
+	}
+	if stored.Acks == nil {
+		stored.Acks = map[string]*AlertAck{}
+	}
+	if stored.NextID < 1 {
+		stored.NextID = int64(len(stored.Alerts)) + 1
+	}
+
+	alertMux.Lock()
+	alerts = stored
+	alertMux.Unlock()
+	return nil
+}
+
+// saveAlertHistory writes a copy of the history taken under alertMux, the file is written without holding it.
+func saveAlertHistory() error {
+	alertMux.Lock()
+	stored := alertStore{Alerts: alerts.Alerts, Acks: make(map[string]*AlertAck, len(alerts.Acks)), NextID: alerts.NextID}
+	for key, ack := range alerts.Acks {
+		copied := *ack
+		stored.Acks[key] = &copied
+	}
+	alertMux.Unlock()
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("failed to encode alert history : %s", err)
+	}
+
+	alertSaveMux.Lock()
+	defer alertSaveMux.Unlock()
+	tmpFile := alertHistoryFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write alert history %s : %s", tmpFile, err)
+	}
+	if err := os.Rename(tmpFile, alertHistoryFile); err != nil {
+		return fmt.Errorf("failed to replace alert history %s : %s", alertHistoryFile, err)
+	}
+	return nil
+}
+
+// alertHistoryChange schedules a save of the history, the alert path never waits on the disk.
+func alertHistoryChange() {
+	select {
+	case alertHistoryChanged <- struct{}{}:
+	default:
+	}
+}
+
+// persistAlertHistory saves the history ALERT_SAVE_DELAY after it changed. The last changes before a shutdown are
+// saved by flushAlertHistory.
+func persistAlertHistory(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-alertHistoryChanged:
+		}
+
+		timer := time.NewTimer(ALERT_SAVE_DELAY)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := saveAlertHistory(); err != nil {
+			alertLog.Error("cannot save the alert history", "error", err)
+		}
+	}
+}
+
+// flushAlertHistory saves the alert history on shutdown.
+func flushAlertHistory() error {
+	return saveAlertHistory()
+}
+
+func recordAlerts(fired []Alert) {
+	if len(fired) == 0 {
+		return
+	}
+
+	alertMux.Lock()
+	defer alertMux.Unlock()
+
+	for _, alert := range fired {
+		alert.ID = alerts.NextID
+		alerts.NextID++
+		alerts.Alerts = append(alerts.Alerts, alert)
+	}
+	if overflow := len(alerts.Alerts) - MAX_ALERT_HISTORY; overflow > 0 {
+		alerts.Alerts = append([]Alert(nil), alerts.Alerts[overflow:]...)
+	}
+
+	alertHistoryChange()
+}
+
+func filterAlerts(filter alertFilter) []Alert {
+	alertMux.Lock()
+	defer alertMux.Unlock()
+
+	var result []Alert
+	for i := len(alerts.Alerts) - 1; i >= 0; i-- {
+		alert := alerts.Alerts[i]
+		if filter.Exchange != "" && !strings.EqualFold(alert.Exchange, filter.Exchange) {
+			continue
+		}
+		if filter.Symbol != "" && !strings.EqualFold(alert.Symbol, filter.Symbol) {
+			continue
+		}
+		if filter.Status != "" && alert.Status != filter.Status {
+			continue
+		}
+		if !filter.Since.IsZero() && alert.Time.Before(filter.Since) {
+			continue
+		}
+
+		result = append(result, alert)
+		if filter.Limit > 0 && len(result) >= filter.Limit {
+			break
+		}
+	}
+	return result
+}
+
+func listAlertAcks() []AlertAck {
+	alertMux.Lock()
+	defer alertMux.Unlock()
+
+	var acks []AlertAck
+	for _, ack := range alerts.Acks {
+		acks = append(acks, *ack)
+	}
+	sort.Slice(acks, func(i, j int) bool { return acks[i].Key < acks[j].Key })
+	return acks
+}
+
+func acknowledgeAlert(key string) {
+	alertMux.Lock()
+	defer alertMux.Unlock()
+
+	ack := alertAckFor(key)
+	ack.Acknowledged = true
+	ack.Time = clockNow()
+	alertHistoryChange()
+}
+
+func snoozeAlert(key string, duration time.Duration) {
+	alertMux.Lock()
+	defer alertMux.Unlock()
+
+	ack := alertAckFor(key)
+	ack.SnoozedUntil = clockNow().Add(duration)
+	ack.Time = clockNow()
+	alertHistoryChange()
+}
+
+func clearAlertAck(key string) {
+	alertMux.Lock()
+	defer alertMux.Unlock()
+
+	if _, ok := alerts.Acks[key]; !ok {
+		return
+	}
+	delete(alerts.Acks, key)
+	alertHistoryChange()
+}
+
+// alertAckFor must be called with alertMux held.
+func alertAckFor(key string) *AlertAck {
+	ack, ok := alerts.Acks[key]
+	if !ok {
+		ack = &AlertAck{Key: key}
+		alerts.Acks[key] = ack
+	}
+	return ack
+}
+
+func isAlertSuppressed(key string, now time.Time) bool {
+	alertMux.Lock()
+	defer alertMux.Unlock()
+
+	ack, ok := alerts.Acks[key]
+	if !ok {
+		return false
+	}
+	return ack.Acknowledged || now.Before(ack.SnoozedUntil)
+}
+
+// releaseAlertAck drops the acknowledgement of a key once its alert condition has cleared, so the next
+// crossing notifies again. Snoozes are kept until they expire.
+func releaseAlertAck(key string, now time.Time) {
+	alertMux.Lock()
+	defer alertMux.Unlock()
+
+	ack, ok := alerts.Acks[key]
+	if !ok || !ack.Acknowledged {
+		return
+	}
+
+	ack.Acknowledged = false
+	if !now.Before(ack.SnoozedUntil) {
+		delete(alerts.Acks, key)
+	}
+	alertHistoryChange()
+}
+
+func parseAlertFilter(c *gin.Context) (alertFilter, error) {
+	filter := alertFilter{
+		Exchange: c.Query("exchange"),
+		Symbol:   c.Query("symbol"),
+		Status:   c.Query("status"),
+		Limit:    200,
+	}
+
+	if limitStr := c.Query("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil {
+			return filter, fmt.Errorf("invalid limit %q : %s", limitStr, err)
+		}
+		filter.Limit = limit
+	}
+
+	if sinceStr := c.Query("since"); sinceStr != "" {
+		since, err := time.Parse(time.RFC3339, sinceStr)
+		if err != nil {
+			return filter, fmt.Errorf("invalid since %q : %s", sinceStr, err)
+		}
+		filter.Since = since
+	}
+
+	return filter, nil
+}
+
+func ListAlerts(c *gin.Context) {
+	filter, err := parseAlertFilter(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.HTML(http.StatusOK, "alerts.tmpl", gin.H{
+		"Alerts":   filterAlerts(filter),
+		"Acks":     listAlertAcks(),
+		"Exchange": filter.Exchange,
+		"Symbol":   filter.Symbol,
+		"Status":   filter.Status,
+		"Now":      clockNow(),
+		"User":     authUser(c),
+		"CSRF":     csrfToken(c),
+	})
+}
+
+func GetAlerts(c *gin.Context) {
+	filter, err := parseAlertFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"alerts": filterAlerts(filter),
+		"acks":   listAlertAcks(),
+	})
+}
+
+func AcknowledgeAlert(c *gin.Context) {
+	key := c.PostForm("key")
+	if key == "" {
+		c.String(http.StatusBadRequest, "missing alert key")
+		return
+	}
+
+	acknowledgeAlert(key)
+	audit(c, authUser(c), "alert acknowledged", "key", key)
+	c.Redirect(http.StatusSeeOther, "/alerts")
+}
+
+func SnoozeAlert(c *gin.Context) {
+	key := c.PostForm("key")
+	if key == "" {
+		c.String(http.StatusBadRequest, "missing alert key")
+		return
+	}
+
+	minutes := DEFAULT_SNOOZE_MINUTES
+	if minutesStr := c.PostForm("minutes"); minutesStr != "" {
+		var err error
+		minutes, err = strconv.ParseFloat(minutesStr, 64)
+		if err != nil || !(minutes > 0) || math.IsInf(minutes, 0) {
+			c.String(http.StatusBadRequest, fmt.Sprintf("invalid snooze minutes %q", minutesStr))
+			return
+		}
+	}
+
+	snoozeAlert(key, time.Duration(minutes*float64(time.Minute)))
+	audit(c, authUser(c), "alert snoozed", "key", key, "minutes", strconv.FormatFloat(minutes, 'f', -1, 64))
+	c.Redirect(http.StatusSeeOther, "/alerts")
+}
+
+func ClearAlertAck(c *gin.Context) {
+	key := c.PostForm("key")
+	if key == "" {
+		c.String(http.StatusBadRequest, "missing alert key")
+		return
+	}
+
+	clearAlertAck(key)
+	audit(c, authUser(c), "alert acknowledgement cleared", "key", key)
+	c.Redirect(http.StatusSeeOther, "/alerts")
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DEFAULT_AUDIT_LOG_FILE = "audit.log"
+	// MAX_AUDIT_ENTRIES is how many entries /api/audit returns, the file keeps them all.
+	MAX_AUDIT_ENTRIES = 500
+)
+
+var (
+	// auditLogFile is where every settings change, login and logout is appended as a JSON line. It is set with
+	// AUDIT_LOG_FILE.
+	auditLogFile = DEFAULT_AUDIT_LOG_FILE
+
+	auditEntries []AuditEntry
+	auditMux     sync.Mutex
+)
+
+func init() {
+	if value := os.Getenv("AUDIT_LOG_FILE"); value != "" {
+		auditLogFile = value
+	}
+}
+
+// AuditEntry records who did what and when. Details are the changed fields as "old -> new" or other context.
+type AuditEntry struct {
+	Time    time.Time         `json:"time"`
+	User    string            `json:"user"`
+	Action  string            `json:"action"`
+	Client  string            `json:"client"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// audit records an action of user. details are key, value pairs.
+func audit(c *gin.Context, user, action string, details ...string) {
+	entry := AuditEntry{Time: time.Now(), User: user, Action: action, Client: clientAddress(c.Request)}
+	if len(details) > 0 {
+		entry.Details = map[string]string{}
+		for i := 0; i+1 < len(details); i += 2 {
+			entry.Details[details[i]] = details[i+1]
+		}
+	}
+
+	auditMux.Lock()
+	defer auditMux.Unlock()
+
+	auditEntries = append(auditEntries, entry)
+	if overflow := len(auditEntries) - MAX_AUDIT_ENTRIES; overflow > 0 {
+		auditEntries = append([]AuditEntry(nil), auditEntries[overflow:]...)
+	}
+
+	auditLog.Info(action, "user", user, "client", entry.Client, "details", entry.Details)
+	if err := appendAuditEntry(entry); err != nil {
+		auditLog.Error("cannot write the audit log", "error", err)
+	}
+}
+
+// loadAuditLog restores the latest MAX_AUDIT_ENTRIES entries of the audit log, so /api/audit keeps its history
+// across restarts.
+func loadAuditLog() error {
+	file, err := os.Open(auditLogFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s : %s", auditLogFile, err)
+	}
+	defer file.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A line cut short by a crash is skipped, the entries after it are still good.
+			auditLog.Warn("cannot parse an audit log entry", "file", auditLogFile, "line", line, "error", err)
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) > 2*MAX_AUDIT_ENTRIES {
+			entries = append([]AuditEntry(nil), entries[len(entries)-MAX_AUDIT_ENTRIES:]...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read audit log %s : %s", auditLogFile, err)
+	}
+	if overflow := len(entries) - MAX_AUDIT_ENTRIES; overflow > 0 {
+		entries = entries[overflow:]
+	}
+
+	auditMux.Lock()
+	auditEntries = append(entries, auditEntries...)
+	if overflow := len(auditEntries) - MAX_AUDIT_ENTRIES; overflow > 0 {
+		auditEntries = append([]AuditEntry(nil), auditEntries[overflow:]...)
+	}
+	auditMux.Unlock()
+	return nil
+}
+
+// appendAuditEntry must be called with auditMux held.
+func appendAuditEntry(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry : %s", err)
+	}
+
+	file, err := os.OpenFile(auditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s : %s", auditLogFile, err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log %s : %s", auditLogFile, err)
+	}
+	return nil
+}
+
+// auditChange adds "old -> new" to details when a setting changed.
+func auditChange(details []string, name string, old, new interface{}) []string {
+	if old == new {
+		return details
+	}
+	return append(details, name, fmt.Sprintf("%v -> %v", old, new))
+}
+
+func GetAuditLog(c *gin.Context) {
+	auditMux.Lock()
+	entries := append([]AuditEntry(nil), auditEntries...)
+	auditMux.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
@@ -0,0 +1,430 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SESSION_COOKIE   = "session"
+	SESSION_LIFETIME = 12 * time.Hour
+	CSRF_FIELD       = "csrf_token"
+	CSRF_HEADER      = "X-CSRF-Token"
+	// LOGIN_CSRF_COOKIE holds the token the login form must send back, there is no session to keep it in yet.
+	LOGIN_CSRF_COOKIE = "login_csrf"
+
+	// MAX_LOGIN_FAILURES failed logins of a user or a client within LOGIN_FAILURE_WINDOW lock it out for
+	// LOGIN_LOCKOUT.
+	MAX_LOGIN_FAILURES   = 5
+	LOGIN_FAILURE_WINDOW = 15 * time.Minute
+	LOGIN_LOCKOUT        = 15 * time.Minute
+
+	// AUTH_USER and AUTH_SESSION are the gin context keys requireLogin sets.
+	AUTH_USER    = "user"
+	AUTH_SESSION = "session"
+)
+
+var (
+	// adminUsers are the logins of the settings pages, set with ADMIN_USERS=name:password,name:password. apiTokens
+	// let scripts in with an "Authorization: Bearer <token>" header, set with API_TOKENS=name:token, and are keyed
+	// by token. Without either nobody can change settings.
+	adminUsers = map[string]string{}
+	apiTokens  = map[string]string{}
+
+	sessions   = map[string]*session{}
+	sessionMux sync.Mutex
+
+	// loginFailures are keyed by "user:<name>" and "client:<ip>", so neither guessing the passwords of one user from
+	// many clients nor trying many users from one client gets around the lockout.
+	loginFailures   = map[string]*loginFailure{}
+	loginFailureMux sync.Mutex
+
+	// trustedProxies are the addresses, or CIDR ranges, of the proxies in front of the server whose X-Forwarded-For
+	// header is believed, set with TRUSTED_PROXIES=10.0.0.0/8,127.0.0.1. Without any the header is ignored.
+	trustedProxies []*net.IPNet
+)
+
+func init() {
+	adminUsers = parseCredentials("ADMIN_USERS")
+	for name, token := range parseCredentials("API_TOKENS") {
+		apiTokens[token] = name
+	}
+	if len(adminUsers) == 0 && len(apiTokens) == 0 {
+		configLog.Warn("no ADMIN_USERS or API_TOKENS set, the settings pages are locked")
+	}
+	trustedProxies = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+}
+
+func parseTrustedProxies(value string) []*net.IPNet {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			configLog.Warn("invalid setting", "name", "TRUSTED_PROXIES", "value", entry, "error", err)
+			continue
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies
+}
+
+func trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddress is the address a request came from. X-Forwarded-For is only read when the connection comes from a
+// trusted proxy, and from the right: every proxy appends the address it saw, so the last entry not added by a
+// trusted proxy is the client and anything before it is whatever the client chose to send.
+func clientAddress(r *http.Request) string {
+	address, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		address = strings.TrimSpace(r.RemoteAddr)
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && trustedProxy(address); i-- {
+		if hop := strings.TrimSpace(forwarded[i]); hop != "" {
+			address = hop
+		}
+	}
+	return address
+}
+
+// parseCredentials reads name:secret pairs separated by commas from a secret. Every secret of the list is redacted
+// on its own, the list as a whole does not show up in a log line.
+func parseCredentials(variable string) map[string]string {
+	credentials := map[string]string{}
+	value := lookupSecret(variable)
+	if value == "" {
+		return credentials
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			configLog.Warn("invalid credential, expected name:secret", "name", variable)
+			continue
+		}
+		addRedaction(parts[1])
+		credentials[parts[0]] = parts[1]
+	}
+	return credentials
+}
+
+// session is a logged in browser. CSRF is the token every form of the session must send back.
+type session struct {
+	User    string
+	CSRF    string
+	Expires time.Time
+}
+
+// loginFailure counts the failed logins of a user or client since First.
+type loginFailure struct {
+	Count       int
+	First       time.Time
+	LockedUntil time.Time
+}
+
+func loginFailureKeys(c *gin.Context, user string) []string {
+	return []string{"user:" + user, "client:" + clientAddress(c.Request)}
+}
+
+// loginLockedUntil returns when the lockout of the user or client of a login ends, zero when neither is locked out.
+func loginLockedUntil(c *gin.Context, user string) time.Time {
+	loginFailureMux.Lock()
+	defer loginFailureMux.Unlock()
+
+	var until time.Time
+	now := time.Now()
+	for _, key := range loginFailureKeys(c, user) {
+		if failure, ok := loginFailures[key]; ok && now.Before(failure.LockedUntil) && failure.LockedUntil.After(until) {
+			until = failure.LockedUntil
+		}
+	}
+	return until
+}
+
+// recordLoginFailure counts a failed login against its user and client and reports whether that locked either out.
+func recordLoginFailure(c *gin.Context, user string) bool {
+	loginFailureMux.Lock()
+	defer loginFailureMux.Unlock()
+
+	now := time.Now()
+	for key, failure := range loginFailures {
+		if now.Sub(failure.First) > LOGIN_FAILURE_WINDOW && now.After(failure.LockedUntil) {
+			delete(loginFailures, key)
+		}
+	}
+
+	locked := false
+	for _, key := range loginFailureKeys(c, user) {
+		failure, ok := loginFailures[key]
+		if !ok {
+			failure = &loginFailure{First: now}
+			loginFailures[key] = failure
+		}
+		failure.Count++
+		if failure.Count >= MAX_LOGIN_FAILURES {
+			failure.Count, failure.First, failure.LockedUntil = 0, now, now.Add(LOGIN_LOCKOUT)
+			locked = true
+		}
+	}
+	return locked
+}
+
+// clearLoginFailures forgets the failed logins of a user and client once they logged in.
+func clearLoginFailures(c *gin.Context, user string) {
+	loginFailureMux.Lock()
+	defer loginFailureMux.Unlock()
+	for _, key := range loginFailureKeys(c, user) {
+		delete(loginFailures, key)
+	}
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func secretsEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func newSession(user string) (string, *session) {
+	id := randomToken()
+	s := &session{User: user, CSRF: randomToken(), Expires: time.Now().Add(SESSION_LIFETIME)}
+
+	sessionMux.Lock()
+	now := time.Now()
+	for key, existing := range sessions {
+		if now.After(existing.Expires) {
+			delete(sessions, key)
+		}
+	}
+	sessions[id] = s
+	sessionMux.Unlock()
+	return id, s
+}
+
+func currentSession(c *gin.Context) (*session, bool) {
+	id, err := c.Cookie(SESSION_COOKIE)
+	if err != nil || id == "" {
+		return nil, false
+	}
+
+	sessionMux.Lock()
+	defer sessionMux.Unlock()
+	s, ok := sessions[id]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(s.Expires) {
+		delete(sessions, id)
+		return nil, false
+	}
+	return s, true
+}
+
+func tokenUser(c *gin.Context) (string, bool) {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	presented := strings.TrimPrefix(header, "Bearer ")
+	for token, name := range apiTokens {
+		if secretsEqual(presented, token) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// requireLogin lets requests with an API token or a session through. Browsers without a session are sent to the
+// login page, other clients get a 401. Session requests that change something must carry the session's CSRF
+// token; token requests cannot be forged by another site and need none.
+func requireLogin(c *gin.Context) {
+	if user, ok := tokenUser(c); ok {
+		c.Set(AUTH_USER, user)
+		c.Next()
+		return
+	}
+
+	s, ok := currentSession(c)
+	if !ok {
+		if c.Request.Method == http.MethodGet && strings.Contains(c.GetHeader("Accept"), "text/html") {
+			c.Redirect(http.StatusSeeOther, "/login?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+			c.Abort()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "login required"})
+		return
+	}
+
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		token := c.PostForm(CSRF_FIELD)
+		if token == "" {
+			token = c.GetHeader(CSRF_HEADER)
+		}
+		if !secretsEqual(token, s.CSRF) {
+			audit(c, s.User, "csrf rejected", "path", c.Request.URL.Path)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid CSRF token"})
+			return
+		}
+	}
+
+	c.Set(AUTH_USER, s.User)
+	c.Set(AUTH_SESSION, s)
+	c.Next()
+}
+
+// authUser is the user requireLogin let in.
+func authUser(c *gin.Context) string {
+	return c.GetString(AUTH_USER)
+}
+
+// csrfToken is the token the forms of a page must send back, empty for token authenticated requests.
+func csrfToken(c *gin.Context) string {
+	if value, ok := c.Get(AUTH_SESSION); ok {
+		return value.(*session).CSRF
+	}
+	return ""
+}
+
+// safeRedirect only allows local paths as the target after login.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/notification"
+	}
+	return next
+}
+
+// loginCSRF returns the token of the login form, set in a cookie the form is checked against.
+func loginCSRF(c *gin.Context) string {
+	token, err := c.Cookie(LOGIN_CSRF_COOKIE)
+	if err != nil || token == "" {
+		token = randomToken()
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     LOGIN_CSRF_COOKIE,
+		Value:    token,
+		Path:     "/login",
+		Secure:   c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+func LoginPage(c *gin.Context) {
+	c.HTML(http.StatusOK, "login.tmpl", gin.H{
+		"Next": safeRedirect(c.Query("next")),
+		"CSRF": loginCSRF(c),
+	})
+}
+
+func Login(c *gin.Context) {
+	user, password := c.PostForm("user"), c.PostForm("password")
+	next := safeRedirect(c.PostForm("next"))
+
+	cookie, err := c.Cookie(LOGIN_CSRF_COOKIE)
+	if err != nil || cookie == "" || !secretsEqual(c.PostForm(CSRF_FIELD), cookie) {
+		audit(c, user, "csrf rejected", "path", c.Request.URL.Path)
+		c.HTML(http.StatusForbidden, "login.tmpl", gin.H{
+			"Next":  next,
+			"User":  user,
+			"CSRF":  loginCSRF(c),
+			"Error": "The login form expired, please try again",
+		})
+		return
+	}
+
+	if until := loginLockedUntil(c, user); !until.IsZero() {
+		audit(c, user, "login locked")
+		c.Header("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+		c.HTML(http.StatusTooManyRequests, "login.tmpl", gin.H{
+			"Next":  next,
+			"User":  user,
+			"CSRF":  loginCSRF(c),
+			"Error": "Too many failed logins, try again later",
+		})
+		return
+	}
+
+	expected, ok := adminUsers[user]
+	// The comparison runs for unknown users as well, so the response time does not tell which users exist.
+	if !secretsEqual(password, expected) || !ok {
+		if recordLoginFailure(c, user) {
+			audit(c, user, "login failed", "lockout", LOGIN_LOCKOUT.String())
+		} else {
+			audit(c, user, "login failed")
+		}
+		c.HTML(http.StatusUnauthorized, "login.tmpl", gin.H{
+			"Next":  next,
+			"User":  user,
+			"CSRF":  loginCSRF(c),
+			"Error": "Invalid user or password",
+		})
+		return
+	}
+
+	clearLoginFailures(c, user)
+	id, _ := newSession(user)
+	secure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(SESSION_LIFETIME.Seconds()),
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(c.Writer, &http.Cookie{Name: LOGIN_CSRF_COOKIE, Value: "", Path: "/login", MaxAge: -1, HttpOnly: true})
+	audit(c, user, "login")
+	c.Redirect(http.StatusSeeOther, next)
+}
+
+func Logout(c *gin.Context) {
+	if id, err := c.Cookie(SESSION_COOKIE); err == nil {
+		sessionMux.Lock()
+		delete(sessions, id)
+		sessionMux.Unlock()
+	}
+	http.SetCookie(c.Writer, &http.Cookie{Name: SESSION_COOKIE, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	audit(c, authUser(c), "logout")
+	c.Redirect(http.StatusSeeOther, "/login")
+}
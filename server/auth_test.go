@@ -0,0 +1,156 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loginTest serves the login page and form of a server with the single admin user admin:secret. post sends the
+// login form with the token of the login page from the given address and X-Forwarded-For header.
+type loginTest struct {
+	router *gin.Engine
+	cookie *http.Cookie
+}
+
+func newLoginTest(t *testing.T) *loginTest {
+	gin.SetMode(gin.TestMode)
+	previousUsers, previousAuditFile, previousProxies := adminUsers, auditLogFile, trustedProxies
+	adminUsers, trustedProxies = map[string]string{"admin": "secret"}, nil
+	auditLogFile = filepath.Join(t.TempDir(), "audit.log")
+	loginFailureMux.Lock()
+	loginFailures = map[string]*loginFailure{}
+	loginFailureMux.Unlock()
+	t.Cleanup(func() {
+		adminUsers, auditLogFile, trustedProxies = previousUsers, previousAuditFile, previousProxies
+		loginFailureMux.Lock()
+		loginFailures = map[string]*loginFailure{}
+		loginFailureMux.Unlock()
+	})
+
+	router := gin.New()
+	router.LoadHTMLGlob("../templates/*")
+	router.GET("/login", LoginPage)
+	router.POST("/login", Login)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == LOGIN_CSRF_COOKIE {
+			if !strings.Contains(w.Body.String(), cookie.Value) {
+				t.Fatal("expected the login form to carry the token of its cookie")
+			}
+			return &loginTest{router: router, cookie: cookie}
+		}
+	}
+	t.Fatal("expected the login page to set a CSRF cookie")
+	return nil
+}
+
+func (l *loginTest) post(user, password, token, remoteAddr, forwardedFor string) int {
+	form := url.Values{"user": {user}, "password": {password}, CSRF_FIELD: {token}}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	req.AddCookie(l.cookie)
+
+	w := httptest.NewRecorder()
+	l.router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestLoginCSRF(t *testing.T) {
+	login := newLoginTest(t)
+
+	if code := login.post("admin", "secret", "", "192.0.2.1:1234", ""); code != http.StatusForbidden {
+		t.Errorf("expected a login without token to be refused with %d, got %d", http.StatusForbidden, code)
+	}
+	if code := login.post("admin", "secret", "forged", "192.0.2.1:1234", ""); code != http.StatusForbidden {
+		t.Errorf("expected a login with a forged token to be refused with %d, got %d", http.StatusForbidden, code)
+	}
+	if code := login.post("admin", "secret", login.cookie.Value, "192.0.2.1:1234", ""); code != http.StatusSeeOther {
+		t.Errorf("expected a login with the token to succeed with %d, got %d", http.StatusSeeOther, code)
+	}
+}
+
+// TestLoginLockout checks that a client is locked out after MAX_LOGIN_FAILURES failed logins, however many users it
+// tries and whatever X-Forwarded-For it claims, and that the audit log records its real address.
+func TestLoginLockout(t *testing.T) {
+	login := newLoginTest(t)
+
+	for i := 0; i < MAX_LOGIN_FAILURES; i++ {
+		user, forwardedFor := fmt.Sprintf("user%d", i), fmt.Sprintf("198.51.100.%d", i+1)
+		if code := login.post(user, "wrong", login.cookie.Value, "192.0.2.1:1234", forwardedFor); code != http.StatusUnauthorized {
+			t.Fatalf("failed login %d : expected %d, got %d", i+1, http.StatusUnauthorized, code)
+		}
+	}
+	if code := login.post("admin", "secret", login.cookie.Value, "192.0.2.1:1234", "203.0.113.9"); code != http.StatusTooManyRequests {
+		t.Errorf("expected the locked out client to get %d, got %d", http.StatusTooManyRequests, code)
+	}
+	if code := login.post("admin", "secret", login.cookie.Value, "192.0.2.2:1234", ""); code != http.StatusSeeOther {
+		t.Errorf("expected another client to log in with %d, got %d", http.StatusSeeOther, code)
+	}
+
+	auditMux.Lock()
+	defer auditMux.Unlock()
+	for _, entry := range auditEntries {
+		if entry.Action == "login failed" && strings.HasPrefix(entry.User, "user") && entry.Client != "192.0.2.1" {
+			t.Errorf("expected the audit log to record the connection's address, got %q", entry.Client)
+		}
+	}
+}
+
+// TestLoginLockoutUser checks that a user is locked out after MAX_LOGIN_FAILURES failed logins from any clients.
+func TestLoginLockoutUser(t *testing.T) {
+	login := newLoginTest(t)
+
+	for i := 0; i < MAX_LOGIN_FAILURES; i++ {
+		remoteAddr := fmt.Sprintf("192.0.2.%d:1234", i+1)
+		if code := login.post("admin", "wrong", login.cookie.Value, remoteAddr, ""); code != http.StatusUnauthorized {
+			t.Fatalf("failed login %d : expected %d, got %d", i+1, http.StatusUnauthorized, code)
+		}
+	}
+	if code := login.post("admin", "secret", login.cookie.Value, "192.0.2.9:1234", ""); code != http.StatusTooManyRequests {
+		t.Errorf("expected the locked out user to get %d, got %d", http.StatusTooManyRequests, code)
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	previous := trustedProxies
+	trustedProxies = parseTrustedProxies("10.0.0.0/8, 127.0.0.1")
+	t.Cleanup(func() { trustedProxies = previous })
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		expected     string
+	}{
+		{name: "direct", remoteAddr: "192.0.2.1:1234", expected: "192.0.2.1"},
+		{name: "direct with forged header", remoteAddr: "192.0.2.1:1234", forwardedFor: "198.51.100.1", expected: "192.0.2.1"},
+		{name: "trusted proxy", remoteAddr: "10.1.2.3:1234", forwardedFor: "198.51.100.1", expected: "198.51.100.1"},
+		{name: "forged entry before the proxy's", remoteAddr: "10.1.2.3:1234", forwardedFor: "203.0.113.9, 198.51.100.1", expected: "198.51.100.1"},
+		{name: "chain of trusted proxies", remoteAddr: "127.0.0.1:1234", forwardedFor: "198.51.100.1, 10.0.0.7", expected: "198.51.100.1"},
+		{name: "trusted proxy without header", remoteAddr: "10.1.2.3:1234", expected: "10.1.2.3"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		if got := clientAddress(req); got != test.expected {
+			t.Errorf("%s : expected %q, got %q", test.name, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	CAPTURE_HTTP = "http"
+	CAPTURE_WS   = "ws"
+
+	CAPTURE_FILE_PREFIX = "capture-"
+	CAPTURE_FILE_SUFFIX = ".jsonl"
+	// CAPTURE_TIME_FORMAT names the capture files, so they sort in the order they were written.
+	CAPTURE_TIME_FORMAT = "20060102T150405.000"
+
+	DEFAULT_CAPTURE_MAX_FILE_SIZE = 64 << 20
+	DEFAULT_CAPTURE_MAX_FILES     = 20
+)
+
+// CaptureRecord is a raw venue payload as it was received: the body of an HTTP response or a websocket frame.
+// Name is the client or feed it was received by, URL the address it came from.
+type CaptureRecord struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Name   string    `json:"name"`
+	Method string    `json:"method,omitempty"`
+	URL    string    `json:"url"`
+	Status int       `json:"status,omitempty"`
+	Data   string    `json:"data"`
+}
+
+// recorder appends CaptureRecords to files in dir, starting a new file once the current one exceeds maxFileSize
+// and removing the oldest files beyond maxFiles.
+type recorder struct {
+	dir         string
+	maxFileSize int64
+	maxFiles    int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// capture is the recorder enabled with RECORD_DIR, nil when nothing is recorded. RECORD_MAX_FILE_SIZE, in bytes,
+// and RECORD_MAX_FILES bound the disk it uses.
+var capture *recorder
+
+func init() {
+	dir := os.Getenv("RECORD_DIR")
+	if dir == "" {
+		return
+	}
+
+	capture = &recorder{dir: dir, maxFileSize: DEFAULT_CAPTURE_MAX_FILE_SIZE, maxFiles: DEFAULT_CAPTURE_MAX_FILES}
+	if value := os.Getenv("RECORD_MAX_FILE_SIZE"); value != "" {
+		if size, err := strconv.ParseInt(value, 10, 64); err != nil || size <= 0 {
+			configLog.Warn("invalid setting", "name", "RECORD_MAX_FILE_SIZE", "value", value)
+		} else {
+			capture.maxFileSize = size
+		}
+	}
+	if value := os.Getenv("RECORD_MAX_FILES"); value != "" {
+		if count, err := strconv.Atoi(value); err != nil || count <= 0 {
+			configLog.Warn("invalid setting", "name", "RECORD_MAX_FILES", "value", value)
+		} else {
+			capture.maxFiles = count
+		}
+	}
+}
+
+// recordResponse captures the body of an HTTP response. It does nothing unless recording is enabled.
+func (r *recorder) recordResponse(name, method, uri string, status int, body []byte) {
+	if r == nil {
+		return
+	}
+	r.record(CaptureRecord{Time: time.Now(), Kind: CAPTURE_HTTP, Name: name, Method: method, URL: uri,
+		Status: status, Data: string(body)})
+}
+
+// recordFrame captures a websocket frame. It does nothing unless recording is enabled.
+func (r *recorder) recordFrame(name, uri string, data []byte) {
+	if r == nil {
+		return
+	}
+	r.record(CaptureRecord{Time: time.Now(), Kind: CAPTURE_WS, Name: name, URL: uri, Data: string(data)})
+}
+
+// record writes a record with every known secret redacted. A record that cannot be written is logged and
+// dropped, recording never stops the server.
+func (r *recorder) record(record CaptureRecord) {
+	record.URL, record.Data = redact(record.URL), redact(record.Data)
+	line, err := json.Marshal(record)
+	if err != nil {
+		captureLog.Error("cannot encode a capture record", "name", record.Name, "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil || r.size+int64(len(line)) > r.maxFileSize {
+		if err := r.rotate(record.Time); err != nil {
+			captureLog.Error("cannot rotate the capture file", "dir", r.dir, "error", err)
+			return
+		}
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		captureLog.Error("cannot write the capture file", "file", r.file.Name(), "error", err)
+	}
+}
+
+// rotate must be called with mu held.
+func (r *recorder) rotate(now time.Time) error {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create capture directory %s : %s", r.dir, err)
+	}
+	name := filepath.Join(r.dir, CAPTURE_FILE_PREFIX+now.UTC().Format(CAPTURE_TIME_FORMAT)+CAPTURE_FILE_SUFFIX)
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create capture file %s : %s", name, err)
+	}
+	r.file, r.size = file, 0
+
+	files, err := captureFiles(r.dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > r.maxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return fmt.Errorf("failed to remove capture file %s : %s", files[0], err)
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// close closes the current capture file on shutdown.
+func (r *recorder) close() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+// captureFiles lists the capture files of dir, oldest first.
+func captureFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, CAPTURE_FILE_PREFIX+"*"+CAPTURE_FILE_SUFFIX))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list capture files in %s : %s", dir, err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
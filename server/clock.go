@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clock is the time the server runs on: when quotes were received and how old they are, how long the loops wait
+// and when an alert may fire again. Network deadlines, rate limits and the durations reported as metrics stay on the
+// wall clock.
+type clock interface {
+	now() time.Time
+	// newTimer returns a channel that receives once d has passed on the clock and a function that stops the timer.
+	newTimer(d time.Duration) (<-chan time.Time, func())
+}
+
+type wallClock struct{}
+
+func (wallClock) now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) newTimer(d time.Duration) (<-chan time.Time, func()) {
+	timer := time.NewTimer(d)
+	return timer.C, func() { timer.Stop() }
+}
+
+// clockHolder keeps the dynamic type stored in serverClock the same.
+type clockHolder struct {
+	clock
+}
+
+// serverClock holds the clock set with setClock, the server runs on the wall clock until then.
+var serverClock atomic.Value
+
+func currentClock() clock {
+	if holder, ok := serverClock.Load().(clockHolder); ok {
+		return holder.clock
+	}
+	return wallClock{}
+}
+
+// setClock runs the server on c and returns the clock it ran on before.
+func setClock(c clock) clock {
+	previous := currentClock()
+	serverClock.Store(clockHolder{c})
+	return previous
+}
+
+func clockNow() time.Time {
+	return currentClock().now()
+}
+
+func clockSince(t time.Time) time.Duration {
+	return clockNow().Sub(t)
+}
+
+// scaledClock runs speed times faster than the wall clock, starting at origin. A replay runs on it, so the server
+// sees the time of the capture and its loops keep the pace of the replay.
+type scaledClock struct {
+	origin  time.Time
+	started time.Time
+	speed   float64
+}
+
+func newScaledClock(origin time.Time, speed float64) *scaledClock {
+	return &scaledClock{origin: origin, started: time.Now(), speed: speed}
+}
+
+func (s *scaledClock) now() time.Time {
+	return s.origin.Add(time.Duration(float64(time.Since(s.started)) * s.speed))
+}
+
+func (s *scaledClock) newTimer(d time.Duration) (<-chan time.Time, func()) {
+	timer := time.NewTimer(time.Duration(float64(d) / s.speed))
+	c := make(chan time.Time, 1)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-timer.C:
+			c <- s.now()
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			timer.Stop()
+			close(done)
+		})
+	}
+}
+
+// virtualClock only moves when it is advanced. It is the scheduler of deterministic tests and backtests: advance
+// fires the timers it passes in the order of their deadlines, each with the clock set to its deadline, and
+// waitTimers tells when the loops woken by them went back to sleep.
+type virtualClock struct {
+	mu      sync.Mutex
+	current time.Time
+	timers  []*virtualTimer
+	// changed is closed and replaced whenever a timer is added.
+	changed chan struct{}
+}
+
+type virtualTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newVirtualClock(start time.Time) *virtualClock {
+	return &virtualClock{current: start, changed: make(chan struct{})}
+}
+
+func (v *virtualClock) now() time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.current
+}
+
+func (v *virtualClock) newTimer(d time.Duration) (<-chan time.Time, func()) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	timer := &virtualTimer{deadline: v.current.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- v.current
+		return timer.c, func() {}
+	}
+
+	// Timers with the same deadline fire in the order they were created.
+	i := sort.Search(len(v.timers), func(i int) bool { return v.timers[i].deadline.After(timer.deadline) })
+	v.timers = append(v.timers, nil)
+	copy(v.timers[i+1:], v.timers[i:])
+	v.timers[i] = timer
+
+	close(v.changed)
+	v.changed = make(chan struct{})
+	return timer.c, func() { v.stop(timer) }
+}
+
+func (v *virtualClock) stop(timer *virtualTimer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for i, pending := range v.timers {
+		if pending == timer {
+			v.timers = append(v.timers[:i], v.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+// advance moves the clock forward by d.
+func (v *virtualClock) advance(d time.Duration) {
+	v.advanceTo(v.now().Add(d))
+}
+
+// advanceTo moves the clock forward to t, firing every timer due by then. The timers the woken loops create next
+// are only fired by a later advance, so a loop runs once per advance however far the clock moves.
+func (v *virtualClock) advanceTo(t time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for len(v.timers) > 0 && !v.timers[0].deadline.After(t) {
+		timer := v.timers[0]
+		v.timers = v.timers[1:]
+		if timer.deadline.After(v.current) {
+			v.current = timer.deadline
+		}
+		timer.c <- v.current
+	}
+	if t.After(v.current) {
+		v.current = t
+	}
+}
+
+// pendingTimers is the number of timers that have not fired yet.
+func (v *virtualClock) pendingTimers() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.timers)
+}
+
+// waitTimers waits until at least n timers are pending, that is until the loops waiting on the clock are asleep
+// again. It reports false when ctx is done first.
+func (v *virtualClock) waitTimers(ctx context.Context, n int) bool {
+	for {
+		v.mu.Lock()
+		pending, changed := len(v.timers), v.changed
+		v.mu.Unlock()
+		if pending >= n {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestVirtualClockLoops runs two loops on a virtual clock and checks they wake up at their intervals, only when the
+// clock is advanced.
+func TestVirtualClockLoops(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	virtual := newVirtualClock(start)
+	previous := setClock(virtual)
+	t.Cleanup(func() { setClock(previous) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), E2E_TIMEOUT)
+	var background loops
+	t.Cleanup(func() {
+		cancel()
+		background.wait(context.Background())
+	})
+
+	runs := make(chan string, 16)
+	every := func(name string, interval time.Duration) func(ctx context.Context) {
+		return func(ctx context.Context) {
+			for sleepContext(ctx, interval) {
+				runs <- name + "@" + clockSince(start).String()
+			}
+		}
+	}
+	background.start(ctx, "fast", every("fast", 2*time.Second))
+	background.start(ctx, "slow", every("slow", 5*time.Second))
+
+	// Loops woken at the same time run concurrently, so the runs of each second are compared as a set.
+	expected := map[int][]string{
+		2:  {"fast@2s"},
+		4:  {"fast@4s"},
+		5:  {"slow@5s"},
+		6:  {"fast@6s"},
+		8:  {"fast@8s"},
+		10: {"fast@10s", "slow@10s"},
+	}
+	for second := 1; second <= 10; second++ {
+		if !virtual.waitTimers(ctx, 2) {
+			t.Fatal("the loops did not go back to sleep")
+		}
+		virtual.advance(time.Second)
+		if !virtual.waitTimers(ctx, 2) {
+			t.Fatal("the loops did not go back to sleep")
+		}
+
+		var got []string
+		for len(runs) > 0 {
+			got = append(got, <-runs)
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(expected[second], ",") {
+			t.Errorf("at %ds expected %v, got %v", second, expected[second], got)
+		}
+	}
+}
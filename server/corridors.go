@@ -0,0 +1,94 @@
+package server
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+const DEFAULT_CORRIDOR = "TRY"
+
+var (
+	// corridors are the local fiats premiums are computed in. Every venue quote in one of them is compared with the
+	// reference converted at that fiat's rate. The list can be replaced with CORRIDORS, e.g. CORRIDORS=TRY,AED.
+	corridors = []string{"TRY", "EUR", "AED"}
+)
+
+func init() {
+	if value := os.Getenv("CORRIDORS"); value != "" {
+		var list []string
+		for _, fiat := range strings.Split(value, ",") {
+			if fiat = strings.ToUpper(strings.TrimSpace(fiat)); fiat != "" && fiat != "USD" {
+				list = append(list, fiat)
+			}
+		}
+		if len(list) == 0 {
+			configLog.Warn("invalid setting", "name", "CORRIDORS", "value", value)
+		} else {
+			corridors = list
+		}
+	}
+
+	rateCurrencies = fiatRateCurrencies()
+}
+
+func isCorridor(currency string) bool {
+	for _, fiat := range corridors {
+		if fiat == currency {
+			return true
+		}
+	}
+	return false
+}
+
+// fiatRateCurrencies are the corridors plus the fiats the reference venues quote in, without USD.
+func fiatRateCurrencies() []string {
+	list := append([]string(nil), corridors...)
+	for _, fiat := range referenceFiats {
+		if fiat != "USD" && !isCorridor(fiat) {
+			list = append(list, fiat)
+		}
+	}
+	return list
+}
+
+// alertExchanges are the venues alerted on: the TRY venues of ALL_EXCHANGES and every venue quoting in one of the
+// other corridors.
+func alertExchanges(snapshot *marketSnapshot) []string {
+	exchanges := append([]string(nil), ALL_EXCHANGES...)
+	seen := map[string]bool{}
+	for _, exchange := range exchanges {
+		seen[exchange] = true
+	}
+	for _, corridor := range corridors {
+		if corridor == "TRY" {
+			continue
+		}
+		for _, exchange := range corridorExchanges(snapshot, corridor) {
+			if !seen[exchange] {
+				seen[exchange] = true
+				exchanges = append(exchanges, exchange)
+			}
+		}
+	}
+	return exchanges
+}
+
+// corridorExchanges lists the venues that quote in the corridor's fiat. The TRY corridor keeps the fixed dashboard
+// order, the others are sorted by name.
+func corridorExchanges(snapshot *marketSnapshot, corridor string) []string {
+	if corridor == "TRY" {
+		return dashboardExchanges
+	}
+
+	seen := map[string]bool{}
+	var exchanges []string
+	for _, quote := range snapshot.LastQuotes {
+		if quote.Currency == corridor && !seen[quote.Exchange] {
+			seen[quote.Exchange] = true
+			exchanges = append(exchanges, quote.Exchange)
+		}
+	}
+	sort.Strings(exchanges)
+	return exchanges
+}
@@ -1,69 +1,92 @@
 package server
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/buger/jsonparser"
 )
 
+const (
+	// FX_REFRESH_INTERVAL is how often the rates are fetched once they are known, the provider's quota is small.
+	FX_REFRESH_INTERVAL = 6 * time.Hour
+	// A failed fetch is retried sooner, readiness waits for every corridor's rate. The backoff doubles up to the max.
+	FX_RETRY_MIN_BACKOFF = time.Minute
+	FX_RETRY_MAX_BACKOFF = 30 * time.Minute
+)
+
 var (
-	tryRate = 0.0
-	aedRate = 0.0
+	// rateCurrencies are the fiat rates fetched per USD, see fiatRateCurrencies.
+	rateCurrencies = []string{"TRY", "EUR"}
 )
 
-func getCurrencies() {
-	for {
-		getCurrencyRates()
-		time.Sleep(6 * time.Hour)
+func getCurrencies(ctx context.Context) {
+	if fxAPIKey == "" {
+		fxLog.Warn("rates not fetched, no API key", "name", FX_API_KEY)
+		return
 	}
-}
 
-func getCurrencyRates() {
-	req, err := http.NewRequest(http.MethodGet, BASE_CURRENCY_URI, nil)
-	if err != nil {
-		fmt.Printf("client: could not create request: %s\n", err)
-	}
+	backoff := FX_RETRY_MIN_BACKOFF
+	for {
+		wait := FX_REFRESH_INTERVAL
+		if err := getCurrencyRates(); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fxLog.Error("cannot get the rates", "error", err, "retry", backoff)
+			wait = backoff
+			if backoff *= 2; backoff > FX_RETRY_MAX_BACKOFF {
+				backoff = FX_RETRY_MAX_BACKOFF
+			}
+		} else {
+			backoff = FX_RETRY_MIN_BACKOFF
+		}
 
-	req.Header.Set("apikey", "8JOnEfDOQ6nlcGkpDrSaAB08vbJNLYrF")
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		fmt.Printf("client: error making http request: %s\n", err)
+		if !sleepContext(ctx, wait) {
+			return
+		}
 	}
+}
 
-	fmt.Printf("client: got response!\n")
-	fmt.Printf("client: status code: %d\n", res.StatusCode)
-
-	resData, err := ioutil.ReadAll(res.Body)
+// getCurrencyRates fetches the rates and publishes the ones it could read. It fails unless every rate was read,
+// so a missing rate is fetched again soon.
+func getCurrencyRates() error {
+	req, err := http.NewRequestWithContext(requestContext(), http.MethodGet, fmt.Sprintf(BASE_CURRENCY_URI, strings.Join(rateCurrencies, ",")), nil)
 	if err != nil {
-		fmt.Printf("client: could not read response body: %s\n", err)
+		return fmt.Errorf("could not create the rates request : %s", err)
 	}
-	fmt.Printf("client: response body: %s\n", resData)
 
-	/*response, err := http.Get(fmt.Sprintf(BASE_CURRENCY_URI, "TRY"))
+	req.Header.Set("apikey", fxAPIKey)
+	resData, err := getClient(FX_PROVIDER).do(req)
 	if err != nil {
-		fmt.Println("failed to get response for currencies : ", err)
-		log.Println("failed to get response for currencies : ", err)
+		return err
 	}
 
-	responseData, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		fmt.Println("failed to read currency response data : ", err)
-		log.Println("failed to read currency response data : ", err)
-	}*/
-
-	tryRateFloat, err := jsonparser.GetFloat(resData, "rates", "TRY")
-	if err != nil {
-		fmt.Println("failed to read the TRY currency price from the response data: ", err)
-		log.Println("failed to read the TRY currency price from the response data: ", err)
+	rates := map[string]float64{}
+	for _, currency := range rateCurrencies {
+		rate, err := jsonparser.GetFloat(resData, "rates", currency)
+		if err != nil || rate == 0.0 {
+			fxLog.Warn("cannot read a rate from the response", "currency", currency, "error", err)
+			continue
+		}
+		rates[currency] = rate
+		fxLog.Info("rate updated", "currency", currency, "rate", rate)
 	}
 
-	if tryRateFloat != 0.0 {
-		tryRate = tryRateFloat
+	if len(rates) > 0 {
+		market.update(func(next *marketSnapshot) {
+			for currency, rate := range rates {
+				next.Rates[currency] = rate
+				next.RateTimes[currency] = clockNow()
+			}
+		})
+		emitQuoteEvent(quoteEvent{ReceivedTime: clockNow()})
 	}
-
-	fmt.Printf("TRY Rate: %f\n", tryRateFloat)
+	if missing := len(rateCurrencies) - len(rates); missing > 0 {
+		return fmt.Errorf("failed to read %d of the %d rates", missing, len(rateCurrencies))
+	}
+	return nil
 }
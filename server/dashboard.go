@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+)
+
+var (
+	dashboardSymbols   = []string{"BTC", "ETH", "LTC", "BCH", "ETC", "XLM", "EOS", "LINK", "DASH", "USDT", "DOGE", "MKR", "ADA"}
+	dashboardExchanges = []string{BTCTURK, BINANCE, KOINIM, PARIBU}
+	dashboardTitles    = map[string]string{BINANCE: "TRBinance"}
+)
+
+// dashboardRow is one symbol line of the index page: the reference price followed by one cell per TRY venue.
+type dashboardRow struct {
+	Symbol         string
+	Reference      string
+	Spread         string
+	ReferenceStale bool
+	ReferenceAge   string
+	// Alternative is the ask of the reference the diffs are not computed against.
+	Alternative string
+	Cells       []dashboardCell
+}
+
+// dashboardCell is a venue's quote for a symbol. Cells of venues that do not list the symbol are not Available,
+// stale cells keep their last prices but have no diff.
+type dashboardCell struct {
+	Available bool
+	HasDiff   bool
+	AskDiff   float64
+	BidDiff   float64
+	AskPrice  float64
+	BidPrice  float64
+	Stale     bool
+	Age       string
+}
+
+func dashboardTitle(exchange string) string {
+	if title, ok := dashboardTitles[exchange]; ok {
+		return title
+	}
+	return exchange
+}
+
+func formatReferencePrice(symbol string, price float64) string {
+	switch symbol {
+	case "USDT", "DOGE":
+		return fmt.Sprintf("%.8f", price)
+	}
+	return strconv.FormatFloat(price, 'f', -1, 64)
+}
+
+// alternativeTitle names the reference shown next to the one the diffs are computed against.
+func alternativeTitle() string {
+	if referenceSource == REFERENCE_COMPOSITE {
+		return GDAX
+	}
+	return COMPOSITE
+}
+
+// formatCompositePrice rounds a computed price, which unlike a venue price has no natural precision.
+func formatCompositePrice(symbol string, price float64) string {
+	switch symbol {
+	case "USDT", "DOGE":
+		return fmt.Sprintf("%.8f", price)
+	}
+	return fmt.Sprintf("%.2f", price)
+}
@@ -0,0 +1,473 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	BITTREX_ORDERBOOK_URI = "https://bittrex.com/api/v1.1/public/getorderbook?market=%s-%s&type=both"
+	BINANCE_DEPTH_URI     = "https://api.binance.com/api/v3/depth?symbol=%s%s&limit=100"
+	BTCTURK_ORDERBOOK_URI = "https://api.btcturk.com/api/v2/orderbook?pairSymbol=%s_%s&limit=100"
+	PARIBU_MARKET_URI     = "https://v3.paribu.com/app/markets/%s-tl"
+
+	DEPTH_INTERVAL          = 30 * time.Second
+	DEFAULT_DEPTH_PERCENT   = 1.0
+	DASHBOARD_OPPORTUNITIES = 5
+	// MAX_LIQUIDITY_AGE is how long a book is used to size opportunities, in case the depth loop stalls.
+	MAX_LIQUIDITY_AGE = 2 * DEPTH_INTERVAL
+)
+
+var (
+	// depthPercent is how far from the mid price, in percent, an order still counts as available liquidity. It can
+	// be overridden with DEPTH_PERCENT.
+	depthPercent = DEFAULT_DEPTH_PERCENT
+
+	// depthSources fetch the order books of a venue. The TRY venues are asked for the symbols they currently quote,
+	// the global venues for the symbols they hedge. Koinim has no source, the public API it is read through only
+	// publishes the ticker.
+	depthSources = []depthSource{
+		{Exchange: BINANCE, Currency: "TRY", getBook: getBinanceOrderBook},
+		{Exchange: BTCTURK, Currency: "TRY", getBook: getBTCTurkOrderBook},
+		{Exchange: PARIBU, Currency: "TRY", getBook: getParibuOrderBook},
+		{Exchange: BINANCE, Currency: "USDT", Symbols: binanceCurrencies, getBook: getBinanceOrderBook},
+		{Exchange: BITTREX, Symbols: bittrexCurrencies, getBook: getBittrexOrderBook},
+	}
+)
+
+func init() {
+	if value := os.Getenv("DEPTH_PERCENT"); value != "" {
+		percent, err := strconv.ParseFloat(value, 64)
+		if err != nil || percent <= 0 {
+			configLog.Warn("invalid setting", "name", "DEPTH_PERCENT", "value", value)
+		} else {
+			depthPercent = percent
+		}
+	}
+}
+
+// bookLevel is a price level of an order book.
+type bookLevel struct {
+	Price    float64
+	Quantity float64
+}
+
+// orderBook is the top of a venue's book for one market. Bids are sorted best first, as are Asks.
+type orderBook struct {
+	Exchange     string
+	Symbol       string
+	Currency     string
+	Bids         []bookLevel
+	Asks         []bookLevel
+	ReceivedTime time.Time
+}
+
+// Liquidity is how much of a market can be traded within depthPercent of its mid price. Quantities are in the
+// traded symbol, notionals in USD so venues quoting different currencies can be compared.
+type Liquidity struct {
+	Exchange     string    `json:"exchange"`
+	Symbol       string    `json:"symbol"`
+	Currency     string    `json:"currency"`
+	Mid          float64   `json:"mid"`
+	Percent      float64   `json:"percent"`
+	BidQuantity  float64   `json:"bidQuantity"`
+	AskQuantity  float64   `json:"askQuantity"`
+	BidUSD       float64   `json:"bidUsd"`
+	AskUSD       float64   `json:"askUsd"`
+	ReceivedTime time.Time `json:"receivedTime"`
+}
+
+// Opportunity is a premium on a local venue together with the size that could actually be traded at it.
+type Opportunity struct {
+	Exchange string  `json:"exchange"`
+	Symbol   string  `json:"symbol"`
+	Side     string  `json:"side"`
+	Diff     float64 `json:"diff"`
+	// SizeUSD is the smaller of the venue's liquidity on the traded side and the best hedge liquidity on a global
+	// venue. It is zero when no order book is known.
+	SizeUSD float64 `json:"sizeUsd"`
+	// Score is the premium earned on SizeUSD, the key the opportunities are ranked by.
+	Score float64 `json:"score"`
+}
+
+type depthSource struct {
+	Exchange string
+	Currency string
+	// Symbols are the symbols to fetch. When empty the tracked symbols the venue currently quotes are used.
+	Symbols []string
+	getBook func(symbol, currency string) (orderBook, error)
+}
+
+func getDepths(ctx context.Context) {
+	for {
+		calculateLiquidity(ctx)
+		if !sleepContext(ctx, DEPTH_INTERVAL) {
+			return
+		}
+	}
+}
+
+// calculateLiquidity fetches every configured order book and replaces the liquidity with the books that could be
+// read. A book that fails has no liquidity until a later cycle reads it again. A cycle interrupted by shutdown
+// publishes nothing.
+func calculateLiquidity(ctx context.Context) {
+	snapshot := market.snapshot()
+	liquidity := map[string]Liquidity{}
+
+	for _, source := range depthSources {
+		symbols := source.Symbols
+		if len(symbols) == 0 {
+			for _, symbol := range quoteSymbols(snapshot.Quotes[source.Exchange]) {
+				if isTracked(symbol) {
+					symbols = append(symbols, symbol)
+				}
+			}
+		}
+
+		for _, symbol := range symbols {
+			if ctx.Err() != nil {
+				return
+			}
+			if symbol == source.Currency {
+				continue
+			}
+
+			book, err := source.getBook(symbol, source.Currency)
+			if err != nil {
+				depthLog.Warn("cannot read an order book", "exchange", source.Exchange, "symbol", symbol, "error", err)
+				continue
+			}
+
+			l, ok := book.liquidity(depthPercent, snapshot)
+			if ok {
+				liquidity[liquidityKey(l.Exchange, l.Symbol, l.Currency)] = l
+			}
+		}
+	}
+
+	market.update(func(next *marketSnapshot) {
+		next.Liquidity = liquidity
+	})
+}
+
+func isTracked(symbol string) bool {
+	for _, tracked := range ALL_SYMBOLS {
+		if tracked == symbol {
+			return true
+		}
+	}
+	return false
+}
+
+func liquidityKey(exchange, symbol, currency string) string {
+	return fmt.Sprintf("%s-%s-%s", exchange, symbol, currency)
+}
+
+func (b orderBook) mid() float64 {
+	if len(b.Bids) == 0 || len(b.Asks) == 0 {
+		return 0
+	}
+	return (b.Bids[0].Price + b.Asks[0].Price) / 2
+}
+
+// liquidity sums the orders within percent of the mid price on both sides. It fails for empty books and for
+// quote currencies that cannot be converted to USD.
+func (b orderBook) liquidity(percent float64, snapshot *marketSnapshot) (Liquidity, bool) {
+	mid := b.mid()
+	usdRate := usdValue(b.Currency, snapshot)
+	if mid == 0 || usdRate == 0 {
+		return Liquidity{}, false
+	}
+
+	l := Liquidity{
+		Exchange:     b.Exchange,
+		Symbol:       b.Symbol,
+		Currency:     b.Currency,
+		Mid:          mid,
+		Percent:      percent,
+		ReceivedTime: b.ReceivedTime,
+	}
+
+	for _, level := range b.Bids {
+		if level.Price < mid*(1-percent/100) {
+			break
+		}
+		l.BidQuantity += level.Quantity
+		l.BidUSD += level.Quantity * level.Price * usdRate
+	}
+	for _, level := range b.Asks {
+		if level.Price > mid*(1+percent/100) {
+			break
+		}
+		l.AskQuantity += level.Quantity
+		l.AskUSD += level.Quantity * level.Price * usdRate
+	}
+	return l, true
+}
+
+// usdValue is the USD value of one unit of a quote currency, zero when it is unknown.
+func usdValue(currency string, snapshot *marketSnapshot) float64 {
+	switch currency {
+	case "USD", "USDT", "USDC":
+		return 1
+	}
+	if rate := snapshot.rate(currency); rate != 0 {
+		return 1 / rate
+	}
+	return snapshot.Reference[currency].Bid
+}
+
+// rankOpportunities lists every fresh premium of the local venues with its tradeable size, best score first. Buying
+// on a venue whose ask is under the reference uses the venue's asks and needs bids on a global venue to hedge,
+// selling above the reference the other way round.
+func rankOpportunities(snapshot *marketSnapshot) []Opportunity {
+	var opportunities []Opportunity
+
+	for key, diff := range snapshot.Diffs {
+		exchange, symbol, side := keyPart(key, 1), keyPart(key, 2), keyPart(key, 3)
+		if (side == "Ask" && diff >= 0) || (side == "Bid" && diff <= 0) {
+			continue
+		}
+
+		currency := snapshot.LastQuotes[fmt.Sprintf("%s-%s", exchange, symbol)].Currency
+		venue, ok := snapshot.Liquidity[liquidityKey(exchange, symbol, currency)]
+		size := 0.0
+		if ok && freshLiquidity(venue) {
+			size = venue.AskUSD
+			if side == "Bid" {
+				size = venue.BidUSD
+			}
+			if hedge, ok := hedgeLiquidity(snapshot, symbol, side); ok {
+				size = math.Min(size, hedge)
+			}
+		}
+
+		opportunities = append(opportunities, Opportunity{
+			Exchange: exchange,
+			Symbol:   symbol,
+			Side:     side,
+			Diff:     diff,
+			SizeUSD:  Round(size, .5, 2),
+			Score:    Round(math.Abs(diff)*size/100, .5, 2),
+		})
+	}
+
+	sort.Slice(opportunities, func(i, j int) bool {
+		if opportunities[i].Score != opportunities[j].Score {
+			return opportunities[i].Score > opportunities[j].Score
+		}
+		return math.Abs(opportunities[i].Diff) > math.Abs(opportunities[j].Diff)
+	})
+	return opportunities
+}
+
+// topOpportunities returns the best ranked opportunities that have a known size.
+func topOpportunities(snapshot *marketSnapshot, count int) []Opportunity {
+	var top []Opportunity
+	for _, o := range rankOpportunities(snapshot) {
+		if len(top) == count || o.SizeUSD == 0 {
+			break
+		}
+		top = append(top, o)
+	}
+	return top
+}
+
+// hedgeLiquidity is the deepest opposite side of the symbol among the books not quoted in a local fiat.
+func hedgeLiquidity(snapshot *marketSnapshot, symbol, side string) (float64, bool) {
+	best, found := 0.0, false
+	for _, l := range snapshot.Liquidity {
+		if l.Symbol != symbol || isCorridor(l.Currency) || !freshLiquidity(l) {
+			continue
+		}
+		size := l.BidUSD
+		if side == "Bid" {
+			size = l.AskUSD
+		}
+		if !found || size > best {
+			best, found = size, true
+		}
+	}
+	return best, found
+}
+
+// freshLiquidity reports whether the book was read recently enough to size an opportunity with.
+func freshLiquidity(l Liquidity) bool {
+	return clockSince(l.ReceivedTime) <= MAX_LIQUIDITY_AGE
+}
+
+func GetLiquidity(c *gin.Context) {
+	snapshot := market.snapshot()
+
+	var list []Liquidity
+	for _, l := range snapshot.Liquidity {
+		list = append(list, l)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return liquidityKey(list[i].Exchange, list[i].Symbol, list[i].Currency) <
+			liquidityKey(list[j].Exchange, list[j].Symbol, list[j].Currency)
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"percent":   depthPercent,
+		"liquidity": list,
+	})
+}
+
+func GetOpportunities(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"opportunities": rankOpportunities(market.snapshot()),
+	})
+}
+
+// bittrexMarket returns the Bittrex market a symbol is traded in. Bittrex names markets quote first.
+func bittrexMarket(symbol string) string {
+	if symbol == "USDT" {
+		return "USD"
+	}
+	return "BTC"
+}
+
+func getBittrexOrderBook(symbol, currency string) (orderBook, error) {
+	if currency == "" {
+		currency = bittrexMarket(symbol)
+	}
+	book := orderBook{Exchange: BITTREX, Symbol: symbol, Currency: currency}
+
+	responseData, err := getClient(BITTREX).get(fmt.Sprintf(BITTREX_ORDERBOOK_URI, currency, symbol))
+	if err != nil {
+		return book, fmt.Errorf("failed to get Bittrex order book response : %s", err)
+	}
+	book.ReceivedTime = clockNow()
+
+	if success, _ := jsonparser.GetBoolean(responseData, "success"); !success {
+		message, _ := jsonparser.GetString(responseData, "message")
+		return book, fmt.Errorf("Bittrex order book request failed : %s", message)
+	}
+
+	readLevels := func(side string) ([]bookLevel, error) {
+		var levels []bookLevel
+		var returnError error
+		jsonparser.ArrayEach(responseData, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+			price, errPrice := jsonparser.GetFloat(value, "Rate")
+			quantity, errQuantity := jsonparser.GetFloat(value, "Quantity")
+			if errPrice != nil || errQuantity != nil {
+				returnError = fmt.Errorf("failed to read a %s level from the Bittrex order book", side)
+				return
+			}
+			levels = append(levels, bookLevel{Price: price, Quantity: quantity})
+		}, "result", side)
+		return levels, returnError
+	}
+
+	if book.Bids, err = readLevels("buy"); err != nil {
+		return book, err
+	}
+	if book.Asks, err = readLevels("sell"); err != nil {
+		return book, err
+	}
+	return book, nil
+}
+
+func getBinanceOrderBook(symbol, currency string) (orderBook, error) {
+	book := orderBook{Exchange: BINANCE, Symbol: symbol, Currency: currency}
+
+	responseData, err := getClient(BINANCE).get(fmt.Sprintf(BINANCE_DEPTH_URI, symbol, currency))
+	if err != nil {
+		return book, fmt.Errorf("failed to get Binance order book response : %s", err)
+	}
+	book.ReceivedTime = clockNow()
+
+	if book.Bids, err = readLevelArrays(responseData, "bids"); err != nil {
+		return book, fmt.Errorf("failed to read the bids from the Binance order book : %s", err)
+	}
+	if book.Asks, err = readLevelArrays(responseData, "asks"); err != nil {
+		return book, fmt.Errorf("failed to read the asks from the Binance order book : %s", err)
+	}
+	return book, nil
+}
+
+func getBTCTurkOrderBook(symbol, currency string) (orderBook, error) {
+	book := orderBook{Exchange: BTCTURK, Symbol: symbol, Currency: currency}
+
+	responseData, err := getClient(BTCTURK).get(fmt.Sprintf(BTCTURK_ORDERBOOK_URI, symbol, currency))
+	if err != nil {
+		return book, fmt.Errorf("failed to get BTCTurk order book response : %s", err)
+	}
+	book.ReceivedTime = clockNow()
+
+	if book.Bids, err = readLevelArrays(responseData, "data", "bids"); err != nil {
+		return book, fmt.Errorf("failed to read the bids from the BTCTurk order book : %s", err)
+	}
+	if book.Asks, err = readLevelArrays(responseData, "data", "asks"); err != nil {
+		return book, fmt.Errorf("failed to read the asks from the BTCTurk order book : %s", err)
+	}
+	return book, nil
+}
+
+// getParibuOrderBook reads the order book of a Paribu market. Paribu sends each side as an object of amounts keyed by
+// price, in no particular order.
+func getParibuOrderBook(symbol, currency string) (orderBook, error) {
+	book := orderBook{Exchange: PARIBU, Symbol: symbol, Currency: currency}
+
+	responseData, err := getClient(PARIBU).get(fmt.Sprintf(PARIBU_MARKET_URI, strings.ToLower(symbol)))
+	if err != nil {
+		return book, fmt.Errorf("failed to get Paribu order book response : %s", err)
+	}
+	book.ReceivedTime = clockNow()
+
+	if book.Bids, err = readLevelObject(responseData, "data", "orderBook", "buy"); err != nil {
+		return book, fmt.Errorf("failed to read the bids from the Paribu order book : %s", err)
+	}
+	if book.Asks, err = readLevelObject(responseData, "data", "orderBook", "sell"); err != nil {
+		return book, fmt.Errorf("failed to read the asks from the Paribu order book : %s", err)
+	}
+	sort.Slice(book.Bids, func(i, j int) bool { return book.Bids[i].Price > book.Bids[j].Price })
+	sort.Slice(book.Asks, func(i, j int) bool { return book.Asks[i].Price < book.Asks[j].Price })
+	return book, nil
+}
+
+// readLevelObject reads a side of a book sent as {"price": quantity}.
+func readLevelObject(data []byte, keys ...string) ([]bookLevel, error) {
+	var levels []bookLevel
+	err := jsonparser.ObjectEach(data, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		price, errPrice := strconv.ParseFloat(string(key), 64)
+		quantity, errQuantity := strconv.ParseFloat(string(value), 64)
+		if errPrice != nil || errQuantity != nil || (dataType != jsonparser.Number && dataType != jsonparser.String) {
+			return fmt.Errorf("invalid level %s: %s", key, strings.TrimSpace(string(value)))
+		}
+		levels = append(levels, bookLevel{Price: price, Quantity: quantity})
+		return nil
+	}, keys...)
+	return levels, err
+}
+
+// readLevelArrays reads the [price, quantity] pairs most venues return their books as.
+func readLevelArrays(data []byte, keys ...string) ([]bookLevel, error) {
+	var levels []bookLevel
+	var returnError error
+
+	_, err := jsonparser.ArrayEach(data, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		price, errPrice := getJSONFloat(value, "[0]")
+		quantity, errQuantity := getJSONFloat(value, "[1]")
+		if errPrice != nil || errQuantity != nil {
+			returnError = fmt.Errorf("invalid level %s", strings.TrimSpace(string(value)))
+			return
+		}
+		levels = append(levels, bookLevel{Price: price, Quantity: quantity})
+	}, keys...)
+	if err != nil {
+		return nil, err
+	}
+	return levels, returnError
+}
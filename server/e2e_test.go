@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const E2E_TIMEOUT = 15 * time.Second
+
+// TestEndToEnd runs the feeds, the REST polls, the rates and the diff loop against the fake exchange and checks the
+// diffs the recorded payloads produce and the alerts they send.
+//
+// The REST snapshots of Paribu and BTCTurk are within the alert thresholds, their websocket frames move BTC out of
+// them: Paribu bids 5% over the reference, BTCTurk asks 3% under it. The reference is 50000 USD at 30 TRY.
+func TestEndToEnd(t *testing.T) {
+	fake := newFakeExchange(t)
+	useFakeExchange(t, fake)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var background loops
+	t.Cleanup(func() {
+		cancel()
+		stopped, stop := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer stop()
+		if !background.wait(stopped) {
+			t.Errorf("loops did not stop within %s", SHUTDOWN_TIMEOUT)
+		}
+	})
+	setRequestContext(ctx)
+
+	background.start(ctx, "currencies", getCurrencies)
+	background.start(ctx, GDAX, startCoinbaseProWS)
+	background.start(ctx, BINANCE, startBinanceWS)
+	background.start(ctx, BTCTURK, startBTCTurkWS)
+	background.start(ctx, PARIBU, startParibuWS)
+	background.start(ctx, "prices", getPrices)
+	background.start(ctx, "diffs", calculateDiffs)
+
+	expected := map[string]float64{
+		"GDAX-Paribu-BTC-Ask":  5.1,
+		"GDAX-Paribu-BTC-Bid":  5,
+		"GDAX-BTCTurk-BTC-Ask": -3,
+		"GDAX-BTCTurk-BTC-Bid": -3.07,
+		"GDAX-Binance-BTC-Ask": 0.2,
+		"GDAX-Binance-BTC-Bid": 0.13,
+		"GDAX-Koinim-BTC-Ask":  0.8,
+		"GDAX-Koinim-BTC-Bid":  0.67,
+		"GDAX-Paribu-ETH-Ask":  0.67,
+		"GDAX-Binance-ETH-Bid": 0.39,
+		"GDAX-BTCTurk-ETH-Ask": 0.33,
+	}
+	var diffs map[string]float64
+	waitFor(t, "the recorded diffs", func() bool {
+		diffs = market.snapshot().Diffs
+		for key, diff := range expected {
+			if value, ok := diffs[key]; !ok || value != diff {
+				return false
+			}
+		}
+		return true
+	}, func() {
+		for key, diff := range expected {
+			t.Logf("%s: expected %v, got %v", key, diff, diffs[key])
+		}
+	})
+
+	if rate := market.snapshot().rate("TRY"); rate != 30 {
+		t.Errorf("expected the TRY rate of the fake provider, got %v", rate)
+	}
+
+	expectedMessages := []string{"Paribu BTC %5.00 1575000", "BTCTurk BTC %-3.00 1455000"}
+	var sent string
+	waitFor(t, "the alerts", func() bool {
+		sent = ""
+		for _, message := range fake.sentMessages() {
+			if message.Get("user") != "fake-user" || message.Get("token") != "fake-token" {
+				t.Fatalf("alert sent without the Pushover credentials : %v", message)
+			}
+			sent += message.Get("message")
+		}
+		for _, message := range expectedMessages {
+			if !strings.Contains(sent, message) {
+				return false
+			}
+		}
+		return true
+	}, func() {
+		t.Logf("sent messages: %q", sent)
+	})
+
+	// Only the two venues out of the thresholds alert, once each.
+	for _, line := range strings.Split(strings.TrimSpace(sent), "\n") {
+		if line != expectedMessages[0] && line != expectedMessages[1] {
+			t.Errorf("unexpected alert %q", line)
+		}
+	}
+	recorded := filterAlerts(alertFilter{Limit: 10})
+	if len(recorded) != 2 {
+		t.Fatalf("expected 2 recorded alerts, got %d : %+v", len(recorded), recorded)
+	}
+	for _, alert := range recorded {
+		if alert.Status != ALERT_STATUS_SENT {
+			t.Errorf("expected alert %s to be sent, got %s %s", alert.Key, alert.Status, alert.Error)
+		}
+	}
+
+	// Only the books that are checked are read, Paribu allows a request per second.
+	sources := depthSources
+	t.Cleanup(func() { depthSources = sources })
+	depthSources = []depthSource{
+		{Exchange: BINANCE, Currency: "TRY", Symbols: []string{"BTC", "ETH"}, getBook: getBinanceOrderBook},
+		{Exchange: PARIBU, Currency: "TRY", Symbols: []string{"BTC", "ETH"}, getBook: getParibuOrderBook},
+	}
+	calculateLiquidity(ctx)
+	liquidity := market.snapshot().Liquidity[liquidityKey(BINANCE, "BTC", "TRY")]
+	if liquidity.AskQuantity != 1.6 || liquidity.BidQuantity != 1.5 {
+		t.Errorf("expected the recorded Binance BTC book within %v%%, got %+v", depthPercent, liquidity)
+	}
+	// The Paribu book mixes levels inside and outside the band in no particular order.
+	liquidity = market.snapshot().Liquidity[liquidityKey(PARIBU, "BTC", "TRY")]
+	if liquidity.AskQuantity != 0.7 || liquidity.BidQuantity != 0.7 {
+		t.Errorf("expected the recorded Paribu BTC book within %v%%, got %+v", depthPercent, liquidity)
+	}
+}
+
+// useFakeExchange points every venue of the end-to-end test at the fake exchange, switches the other venues off
+// and keeps the files the server writes in a temporary directory. Venues without recorded payloads, like the
+// Bittrex order books, get a 404 from the fake exchange instead of reaching the real one.
+func useFakeExchange(t *testing.T, fake *fakeExchange) {
+	venues := map[string]string{
+		PARIBU:      "paribu",
+		BTCTURK:     "btcturk",
+		BINANCE:     "binance",
+		KOINIM:      "koinim",
+		BITTREX:     "bittrex",
+		GDAX:        "coinbasepro",
+		FX_PROVIDER: "apilayer",
+		PUSHOVER:    "pushover",
+	}
+	for name, venue := range venues {
+		if err := setBaseURL(name, fake.url(venue)); err != nil {
+			t.Fatal(err)
+		}
+		name := name
+		t.Cleanup(func() { setBaseURL(name, "") })
+	}
+
+	for _, status := range adapterStatuses() {
+		if _, ok := venues[status.Name]; !ok && status.State == ADAPTER_ENABLED {
+			setAdapterEnabled(status.Name, false)
+			name := status.Name
+			t.Cleanup(func() { setAdapterEnabled(name, true) })
+		}
+	}
+
+	dir := t.TempDir()
+	previousFiles := []string{alertHistoryFile, settingsFile, auditLogFile}
+	alertHistoryFile = filepath.Join(dir, "alerts.json")
+	settingsFile = filepath.Join(dir, "settings.json")
+	auditLogFile = filepath.Join(dir, "audit.log")
+
+	previousSecrets := []string{fxAPIKey, PUSHOVER_USER, PUSHOVER_APP_TOKEN}
+	fxAPIKey, PUSHOVER_USER, PUSHOVER_APP_TOKEN = FAKE_API_KEY, "fake-user", "fake-token"
+
+	t.Cleanup(func() {
+		alertHistoryFile, settingsFile, auditLogFile = previousFiles[0], previousFiles[1], previousFiles[2]
+		fxAPIKey, PUSHOVER_USER, PUSHOVER_APP_TOKEN = previousSecrets[0], previousSecrets[1], previousSecrets[2]
+	})
+
+	// Alerts of an earlier run in the same process would still be within their duration.
+	for key := range notificationFlags {
+		delete(notificationFlags, key)
+		delete(notificationTimes, key)
+		delete(notificationEscalated, key)
+	}
+	alertMux.Lock()
+	alerts = alertStore{Acks: map[string]*AlertAck{}, NextID: 1}
+	alertMux.Unlock()
+
+	if _, err := os.Stat(FAKE_EXCHANGE_DATA); err != nil {
+		t.Fatalf("missing recorded payloads : %s", err)
+	}
+}
+
+// waitFor polls condition until it holds or E2E_TIMEOUT passes, then calls report and fails the test.
+func waitFor(t *testing.T, what string, condition func() bool, report func()) {
+	t.Helper()
+
+	deadline := time.Now().Add(E2E_TIMEOUT)
+	for !condition() {
+		if time.Now().After(deadline) {
+			report()
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
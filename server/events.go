@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	QUOTE_EVENT_BUFFER   = 1024
+	STALE_SWEEP_INTERVAL = 1 * time.Second
+	// MAX_SWEEP_INTERVAL bounds how long the sweep waits for the feeds to go quiet. Symbols without events of their
+	// own still lose their stale quotes while other symbols keep streaming.
+	MAX_SWEEP_INTERVAL = 5 * time.Second
+)
+
+// quoteEvent announces that quotes changed. Symbols lists the symbols whose diffs must be recomputed, nil meaning
+// all of them; an empty Exchange means the change affects every venue, as a new reference price or FX rate does.
+type quoteEvent struct {
+	Exchange     string
+	Symbols      []string
+	ReceivedTime time.Time
+}
+
+var (
+	quoteEvents        = make(chan quoteEvent, QUOTE_EVENT_BUFFER)
+	droppedQuoteEvents int64
+	// lastDiffPass is when, in Unix nanoseconds, the diff loop last finished a pass.
+	lastDiffPass        int64
+	quoteToDiffLatency  = &latencyStats{}
+	quoteToAlertLatency = &latencyStats{}
+)
+
+// publishQuotes replaces the quotes of a venue and schedules the recalculation of the given symbols. Quotes of a
+// disabled venue are dropped.
+func publishQuotes(exchange string, list []Price, symbols []string, receivedTime time.Time) {
+	if !adapterEnabled(exchange) {
+		return
+	}
+	market.update(func(next *marketSnapshot) {
+		next.Quotes[exchange] = list
+	})
+	emitQuoteEvent(quoteEvent{Exchange: exchange, Symbols: symbols, ReceivedTime: receivedTime})
+}
+
+func quoteSymbols(list []Price) []string {
+	var symbols []string
+	for _, p := range list {
+		symbols = append(symbols, p.ID)
+	}
+	return symbols
+}
+
+// emitQuoteEvent never blocks a feed. When the pipeline falls behind the event is dropped, the sweep recomputes
+// everything within MAX_SWEEP_INTERVAL anyway. An event with an empty, non-nil Symbols changes
+// nothing and is not sent.
+func emitQuoteEvent(event quoteEvent) {
+	if event.Symbols != nil && len(event.Symbols) == 0 {
+		return
+	}
+	select {
+	case quoteEvents <- event:
+	default:
+		atomic.AddInt64(&droppedQuoteEvents, 1)
+	}
+}
+
+// calculateDiffs recomputes diffs and evaluates alerts as soon as quotes change. Events that queued up while a
+// batch was processed are merged into the next batch. A sweep recomputes every symbol so quotes that went stale
+// without any new event drop out of the diffs. It is a backstop: it only runs once no event arrived for
+// STALE_SWEEP_INTERVAL, or when the last sweep is MAX_SWEEP_INTERVAL old, so busy feeds are not recomputed twice.
+func calculateDiffs(ctx context.Context) {
+	sweep, stopSweep := currentClock().newTimer(STALE_SWEEP_INTERVAL)
+	defer func() { stopSweep() }()
+	lastEvent, lastSweep := clockNow(), clockNow()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushQuoteEvents()
+			return
+		case event := <-quoteEvents:
+			batch := []quoteEvent{event}
+		drain:
+			for {
+				select {
+				case event := <-quoteEvents:
+					batch = append(batch, event)
+				default:
+					break drain
+				}
+			}
+			processQuoteEvents(batch)
+			lastEvent = clockNow()
+		case <-sweep:
+			if now := clockNow(); now.Sub(lastEvent) >= STALE_SWEEP_INTERVAL || now.Sub(lastSweep) >= MAX_SWEEP_INTERVAL {
+				processQuoteEvents([]quoteEvent{{}})
+				lastSweep = now
+			}
+			sweep, stopSweep = currentClock().newTimer(STALE_SWEEP_INTERVAL)
+		}
+	}
+}
+
+func processQuoteEvents(batch []quoteEvent) {
+	start := time.Now()
+	defer func() {
+		diffLoopDuration.observe(time.Since(start))
+		atomic.StoreInt64(&lastDiffPass, time.Now().UnixNano())
+	}()
+
+	var symbols []string
+	var receivedTime time.Time
+	allSymbols, allExchanges := false, false
+	symbolSet, exchangeSet := map[string]bool{}, map[string]bool{}
+
+	for _, event := range batch {
+		if event.Symbols == nil {
+			allSymbols = true
+		}
+		for _, symbol := range event.Symbols {
+			if !symbolSet[symbol] {
+				symbolSet[symbol] = true
+				symbols = append(symbols, symbol)
+			}
+		}
+
+		if event.Exchange == "" || event.Exchange == GDAX {
+			allExchanges = true
+		}
+		exchangeSet[event.Exchange] = true
+
+		if !event.ReceivedTime.IsZero() && (receivedTime.IsZero() || event.ReceivedTime.Before(receivedTime)) {
+			receivedTime = event.ReceivedTime
+		}
+	}
+	if allSymbols {
+		symbols = nil
+	}
+
+	snapshot := findPriceDifferences(symbols)
+	if !receivedTime.IsZero() {
+		quoteToDiffLatency.observe(clockSince(receivedTime))
+	}
+
+	var pairs []alertPair
+	for _, exchange := range alertExchanges(snapshot) {
+		if !allExchanges && !exchangeSet[exchange] {
+			continue
+		}
+		for _, symbol := range ALL_SYMBOLS {
+			if allSymbols || symbolSet[symbol] {
+				pairs = append(pairs, alertPair{Exchange: exchange, Symbol: symbol})
+			}
+		}
+	}
+	sendMessages(snapshot, pairs, receivedTime)
+}
+
+// flushQuoteEvents evaluates the events still queued at shutdown, so alerts they trigger are still sent.
+func flushQuoteEvents() {
+	var batch []quoteEvent
+	for {
+		select {
+		case event := <-quoteEvents:
+			batch = append(batch, event)
+		default:
+			if len(batch) > 0 {
+				processQuoteEvents(batch)
+			}
+			return
+		}
+	}
+}
+
+// latencyStats summarises how long it takes from receiving a quote to acting on it.
+type latencyStats struct {
+	mu    sync.Mutex
+	count int64
+	sum   time.Duration
+	max   time.Duration
+	last  time.Duration
+}
+
+// LatencySummary is the JSON view of latencyStats.
+type LatencySummary struct {
+	Count     int64   `json:"count"`
+	AverageMs float64 `json:"averageMs"`
+	MaxMs     float64 `json:"maxMs"`
+	LastMs    float64 `json:"lastMs"`
+}
+
+func (l *latencyStats) observe(latency time.Duration) {
+	l.mu.Lock()
+	l.count++
+	l.sum += latency
+	l.last = latency
+	if latency > l.max {
+		l.max = latency
+	}
+	l.mu.Unlock()
+}
+
+func (l *latencyStats) summary() LatencySummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	summary := LatencySummary{Count: l.count, MaxMs: milliseconds(l.max), LastMs: milliseconds(l.last)}
+	if l.count > 0 {
+		summary.AverageMs = milliseconds(l.sum) / float64(l.count)
+	}
+	return summary
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// GetLatency reports how long quotes take to reach the diffs and the alerting.
+func GetLatency(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"quoteToDiff":   quoteToDiffLatency.summary(),
+		"quoteToAlert":  quoteToAlertLatency.summary(),
+		"droppedEvents": atomic.LoadInt64(&droppedQuoteEvents),
+	})
+}
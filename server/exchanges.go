@@ -1,11 +1,9 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -25,13 +23,19 @@ const (
 	VEBITCOIN_URI            = "https://prod-data-publisher.azurewebsites.net/api/ticker"
 	BINANCE_URI              = "https://api.binance.com/api/v3/ticker/bookTicker?symbol=%s%s"
 	BITTREX_URI              = "https://bittrex.com/api/v1.1/public/getticker?market=%s-%s"
-	BITTREX_DOGE_VOLUME_URI  = "https://bittrex.com/api/v1.1/public/getorderbook?market=BTC-DOGE&type=both"
-	BITFINEX_URI             = "https://api.bitfinex.com/v1/pubticker/%sUSD"
+	BITOASIS_URI             = "https://api.bitoasis.net/v1/exchange/ticker/%s-AED"
+	BITFINEX_URI             = "https://api-pub.bitfinex.com/v2/tickers?symbols=%s"
+	COINBASE_PRO_WS_URI      = "wss://ws-feed.pro.coinbase.com"
+
+	COINBASE_PRO_SILENCE_TIMEOUT = 10 * time.Second
 
 	GDAX      = "GDAX"
 	BINANCE   = "Binance"
 	BITTREX   = "Bittrex"
 	BITFINEX  = "Bitfinex"
+	KRAKEN    = "Kraken"
+	BITSTAMP  = "Bitstamp"
+	BITOASIS  = "BitOasis"
 	PARIBU    = "Paribu"
 	BTCTURK   = "BTCTurk"
 	KOINEKS   = "Koineks"
@@ -42,17 +46,17 @@ const (
 var (
 	symbolToExchangeNames map[string][]string
 
-	ALL_EXCHANGES      = []string{PARIBU, BTCTURK, KOINEKS, KOINIM, VEBITCOIN}
+	ALL_EXCHANGES      = []string{PARIBU, BTCTURK, KOINEKS, KOINIM, VEBITCOIN, BITOASIS}
 	bittrexCurrencies  = []string{"USDT", "DOGE", "XLM"}
 	binanceCurrencies  = []string{"ADA", "BTC", "ETH", "DOGE", "ETC", "EOS", "LINK", "USDT", "XLM"}
+	paribuCurrencies   = []string{"BTC", "ETH", "LTC", "BCH", "DOGE", "XLM", "EOS", "USDT", "LINK", "MKR", "ADA"}
 	coinbaseProCurrencies = []string{
 		"BTC-USD", "BCH-USD", "ETH-USD", "LTC-USD", "ETC-USD", "ZRX-USD", "XLM-USD", "EOS-USD", "LINK-USD",
 		"DASH-USD", "ZEC-USD", "MKR-USD", "ADA-USD", "BAT-USDC", "USDT-USD", "DOGE-USD",
 	}
 
 	bitfinexCurrencies = []string{"BTC", "ETH", "LTC", "XLM"}
-
-	wsDialer ws.Dialer
+	bitOasisCurrencies = []string{"BTC", "ETH", "LTC", "BCH", "XLM", "USDT"}
 )
 
 func init() {
@@ -65,100 +69,97 @@ func init() {
 			notificationTimes[exchangeSymbol] = time.Time{}
 		}
 	}
+}
 
-	coinbaseProPrices = map[string]*Price{}
-	for _, symbol := range ALL_SYMBOLS {
-		coinbaseProPrices[symbol] = &Price{Exchange: GDAX, Currency: "USD", ID: symbol}
+func startCoinbaseProWS(ctx context.Context) {
+	feed := registerFeed(&wsFeed{
+		name:           GDAX,
+		uri:            COINBASE_PRO_WS_URI,
+		silenceTimeout: COINBASE_PRO_SILENCE_TIMEOUT,
+		subscribe:      subscribeCoinbasePro,
+		handle:         handleCoinbaseProMessage,
+		onDown:         refreshReferenceDiffs,
+	})
+	feed.run(ctx)
+}
 
+func subscribeCoinbasePro(conn *ws.Conn) error {
+	subscribe := coinbasepro.Message{
+		Type: "subscribe",
+		Channels: []coinbasepro.MessageChannel{
+			coinbasepro.MessageChannel{
+				Name:       "ticker",
+				ProductIds: coinbaseProCurrencies,
+			},
+			coinbasepro.MessageChannel{
+				Name:       "heartbeat",
+				ProductIds: coinbaseProCurrencies,
+			},
+		},
 	}
+	return conn.WriteJSON(subscribe)
+}
 
-	diffs = map[string]float64{}
-	prices = map[string]float64{}
-	spreads = map[string]float64{}
-	dogeVolumes = map[string]float64{}
-
-	minDiffs, maxDiffs = map[string]float64{}, map[string]float64{}
-	minSymbol, maxSymbol = map[string]string{}, map[string]string{}
+func handleCoinbaseProMessage(data []byte) error {
+	message := coinbasepro.Message{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		return fmt.Errorf("cannot parse coinbase pro message : %s", err)
+	}
 
-	PUSHOVER_USER = os.Getenv("PUSHOVER_USER")
-	PUSHOVER_APP_TOKEN = os.Getenv("PUSHOVER_APP_TOKEN")
-}
+	switch message.Type {
+	case "error":
+		return fmt.Errorf("coinbase pro websocket error : %s %s", message.Message, message.Reason)
+	case "ticker":
+	default:
+		return nil
+	}
 
-func startCoinbaseProWS() error {
-	var wsDialer ws.Dialer
-  wsConn, _, err := wsDialer.Dial("wss://ws-feed.pro.coinbase.com", nil)
-  if err != nil {
-    println(err.Error())
-    return err
-  }
-
-  subscribe := coinbasepro.Message{
-    Type:      "subscribe",
-    Channels: []coinbasepro.MessageChannel{
-      coinbasepro.MessageChannel{
-        Name: "ticker",
-        ProductIds: coinbaseProCurrencies,
-      },
-    },
-  }
-  if err := wsConn.WriteJSON(subscribe); err != nil {
-    println(err.Error())
-    return err
-  }
-
-  for true {
-    message := coinbasepro.Message{}
-    if err := wsConn.ReadJSON(&message); err != nil {
-      println(err.Error())
-      log.Println(fmt.Sprintf("Cannot read coinbase pro messages : ", err.Error()))
-      continue
-    }
-
-		if message.ProductID !=  "" {
-	    id := message.ProductID
-	    tempID := ""
-			if strings.HasSuffix(id, "-USD") {
-				tempID = id[0:len(id)-4]
-			}
+	if message.ProductID != "" {
+		id := message.ProductID
+		tempID := ""
+		if strings.HasSuffix(id, "-USD") {
+			tempID = id[0 : len(id)-4]
+		}
 
-			if strings.HasSuffix(id, "-USDC") {
-				tempID = id[0:len(id)-5]
-			}
+		if strings.HasSuffix(id, "-USDC") {
+			tempID = id[0 : len(id)-5]
+		}
 
-			pAsk, _ := strconv.ParseFloat(message.BestAsk, 64)
-			pBid, _ := strconv.ParseFloat(message.BestBid, 64)
-			mux.Lock()
-			spreads[GDAX+tempID] = (pAsk - pBid) * 100 / pBid
-
-			p, ok := coinbaseProPrices[tempID]
-			if !ok {
-				coinbaseProPrices[tempID] = &Price{Exchange: GDAX, Currency: "USD", ID: tempID, Ask: pAsk, Bid: pBid}
-			} else {
-				p.Ask = pAsk
-				p.Bid = pBid
-			}
-			mux.Unlock()
+		receivedTime := clockNow()
+		pAsk, errAsk := strconv.ParseFloat(message.BestAsk, 64)
+		pBid, errBid := strconv.ParseFloat(message.BestBid, 64)
+		if errAsk != nil || errBid != nil {
+			// A malformed ticker is dropped, it is no reason to reconnect.
+			recordIncident(GDAX, fmt.Sprintf("%s %q / %q", id, message.BestAsk, message.BestBid), REJECT_UNPARSEABLE, receivedTime)
+			return nil
 		}
-  }
+		// The ticker's 24 hour volume weighs the venue in the reference index.
+		volume, _ := getJSONFloat(data, "volume_24h")
+		p := Price{Exchange: GDAX, Currency: "USD", ID: tempID, Ask: pAsk, Bid: pBid, Volume: volume,
+			ExchangeTime: time.Time(message.Time), ReceivedTime: receivedTime}
+		if !acceptQuote(GDAX, p, receivedTime) {
+			return nil
+		}
+		market.update(func(next *marketSnapshot) {
+			next.Reference[tempID] = p
+		})
+		// A new reference price moves the diffs of the symbol on every venue.
+		emitQuoteEvent(quoteEvent{Symbols: []string{tempID}, ReceivedTime: receivedTime})
+	}
 
-  return nil
+	return nil
 }
 
 func getParibuPrices() ([]Price, error) {
 	var prices []Price
 
-	response, err := http.Get(PARIBU_URI)
+	responseData, err := getClient(PARIBU).get(PARIBU_URI)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get Paribu response : %s", err)
 	}
+	receivedTime := clockNow()
 
-	responseData, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read Paribu response data : %s", err)
-	}
-
-	ids := []string{"BTC", "ETH", "LTC", "BCH", "DOGE", "XLM", "EOS", "USDT", "LINK", "MKR", "ADA"}
-	for _, id := range ids {
+	for _, id := range paribuCurrencies {
 		priceAsk, err := jsonparser.GetFloat(responseData, fmt.Sprintf("%s_TL", id), "lowestAsk")
 		if err != nil {
 			return nil, fmt.Errorf("failed to read the ask price from the Paribu response data: %s", err)
@@ -169,23 +170,44 @@ func getParibuPrices() ([]Price, error) {
 			return nil, fmt.Errorf("failed to read the bid price from the Paribu response data: %s", err)
 		}
 
-		prices = append(prices, Price{Exchange: PARIBU, Currency: "TRY", ID: id, Ask: priceAsk, Bid: priceBid})
+		prices = append(prices, Price{Exchange: PARIBU, Currency: "TRY", ID: id, Ask: priceAsk, Bid: priceBid, ReceivedTime: receivedTime})
 	}
 	return prices, nil
 }
 
-func getBTCTurkPrices() ([]Price, error) {
+func getBitOasisPrices() ([]Price, error) {
 	var prices []Price
 
-	response, err := http.Get(BTCTURK_URI)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get BTCTurk response : %s", err)
+	for _, id := range bitOasisCurrencies {
+		responseData, err := getClient(BITOASIS).get(fmt.Sprintf(BITOASIS_URI, id))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get BitOasis response : %s", err)
+		}
+		receivedTime := clockNow()
+
+		priceAsk, err := getJSONFloat(responseData, "ticker", "ask")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the %s ask price from the BitOasis response data: %s", id, err)
+		}
+
+		priceBid, err := getJSONFloat(responseData, "ticker", "bid")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the %s bid price from the BitOasis response data: %s", id, err)
+		}
+
+		prices = append(prices, Price{Exchange: BITOASIS, Currency: "AED", ID: id, Ask: priceAsk, Bid: priceBid, ReceivedTime: receivedTime})
 	}
+	return prices, nil
+}
+
+func getBTCTurkPrices() ([]Price, error) {
+	var prices []Price
 
-	responseData, err := ioutil.ReadAll(response.Body)
+	responseData, err := getClient(BTCTURK).get(BTCTURK_URI)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read BTCTurk response data : %s", err)
+		return nil, fmt.Errorf("failed to get BTCTurk response : %s", err)
 	}
+	receivedTime := clockNow()
 
 	var returnError error
 	jsonparser.ArrayEach(responseData, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
@@ -195,17 +217,11 @@ func getBTCTurkPrices() ([]Price, error) {
 			return
 		}
 
-		if !strings.HasSuffix(pairName, "TRY") || pairName == "ETHWTRY"{
+		pair, ok := btcTurkSymbol(pairName)
+		if !ok {
 			return
 		}
 
-		var pair string
-		if pairName == "USDTTRY" || pairName == "LINKTRY" {
-			pair = pairName[0:4]
-		} else {
-			pair = pairName[0:3]
-		}
-
 		priceAsk, err := jsonparser.GetFloat(value, "ask")
 		if err != nil {
 			returnError = fmt.Errorf("failed to read the %s ask price from the BTCTurk response data: %s", pair, err)
@@ -218,7 +234,13 @@ func getBTCTurkPrices() ([]Price, error) {
 			return
 		}
 
-		prices = append(prices, Price{Exchange: BTCTURK, Currency: "TRY", ID: pair, Ask: priceAsk, Bid: priceBid})
+		var exchangeTime time.Time
+		if timestamp, err := jsonparser.GetFloat(value, "timestamp"); err == nil {
+			exchangeTime = time.Unix(0, int64(timestamp)*int64(time.Millisecond))
+		}
+
+		prices = append(prices, Price{Exchange: BTCTURK, Currency: "TRY", ID: pair, Ask: priceAsk, Bid: priceBid,
+			ExchangeTime: exchangeTime, ReceivedTime: receivedTime})
 
 	}, "data")
 
@@ -229,6 +251,15 @@ func getBTCTurkPrices() ([]Price, error) {
 	return prices, nil
 }
 
+// btcTurkSymbol maps a BTCTurk pair name to its symbol and reports false for pairs that are not tracked.
+func btcTurkSymbol(pairName string) (string, bool) {
+	if !strings.HasSuffix(pairName, "TRY") || pairName == "ETHWTRY" {
+		return "", false
+	}
+
+	return strings.TrimSuffix(pairName, "TRY"), true
+}
+
 func getKoinimPrices() ([]Price, error) {
 	var prices []Price
 
@@ -236,15 +267,11 @@ func getKoinimPrices() ([]Price, error) {
 	for _, id := range ids {
 		uri := fmt.Sprintf(KOINIM_URI, id)
 
-		response, err := http.Get(uri)
+		responseData, err := getClient(KOINIM).get(uri)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get Koinim response for %s: %s", id, err)
 		}
-
-		responseData, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read Koinim response data for %s: %s", id, err)
-		}
+		receivedTime := clockNow()
 
 		koinimPriceAsk, err := jsonparser.GetFloat(responseData, "ask")
 		if err != nil {
@@ -256,7 +283,7 @@ func getKoinimPrices() ([]Price, error) {
 			return nil, fmt.Errorf("failed to read the BTC bid price from the Koinim response data: %s", err)
 		}
 
-		prices = append(prices, Price{Exchange: KOINIM, Currency: "TRY", ID: id, Ask: koinimPriceAsk, Bid: koinimPriceBid})
+		prices = append(prices, Price{Exchange: KOINIM, Currency: "TRY", ID: id, Ask: koinimPriceAsk, Bid: koinimPriceBid, ReceivedTime: receivedTime})
 	}
 
 	return prices, nil
@@ -269,31 +296,33 @@ func getKoineksPrices() ([]Price, error) {
 
 	for _, id := range ids {
 
-		response, err := http.Get(fmt.Sprintf(KOINEKS_URI, id))
+		responseData, err := getClient(KOINEKS).get(fmt.Sprintf(KOINEKS_URI, id))
 		if err != nil {
 			return nil, fmt.Errorf("failed to get Koineks response : %s", err)
 		}
-
-		responseData, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read Koineks response data : %s", err)
-		}
+		receivedTime := clockNow()
 
 		priceAsk, err := jsonparser.GetString(responseData, "result", "asks", "[0]", "[0]")
 		if err != nil {
 			return nil, fmt.Errorf("failed to read the ask price from the Koineks response data: %s", err)
 		}
 
-		pAsk, _ := strconv.ParseFloat(priceAsk, 64)
+		pAsk, err := strconv.ParseFloat(priceAsk, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the %s ask price from the Koineks response data: %s", id, err)
+		}
 
 		priceBid, err := jsonparser.GetString(responseData, "result", "bids", "[0]", "[0]")
 		if err != nil {
 			return nil, fmt.Errorf("failed to read the bid price from the Koineks response data: %s", err)
 		}
 
-		pBid, _ := strconv.ParseFloat(priceBid, 64)
+		pBid, err := strconv.ParseFloat(priceBid, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the %s bid price from the Koineks response data: %s", id, err)
+		}
 
-		prices = append(prices, Price{Exchange: KOINEKS, Currency: "TRY", ID: id, Ask: pAsk, Bid: pBid})
+		prices = append(prices, Price{Exchange: KOINEKS, Currency: "TRY", ID: id, Ask: pAsk, Bid: pBid, ReceivedTime: receivedTime})
 	}
 
 	return prices, nil
@@ -302,41 +331,49 @@ func getKoineksPrices() ([]Price, error) {
 func getVebitcoinPrices() ([]Price, error) {
 	var prices []Price
 
-	response, err := http.Get(VEBITCOIN_URI)
+	responseData, err := getClient(VEBITCOIN).get(VEBITCOIN_URI)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get Vebitcoin response: %s", err)
 	}
+	receivedTime := clockNow()
 
-	responseData, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read Vebitcoin response data: %s", err)
-	}
-
+	var returnError error
 	jsonparser.ArrayEach(responseData, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
-		targetCoin, errRet := jsonparser.GetString(value, "TargetCoinCode")
-		if errRet != nil {
-			err = fmt.Errorf("failed to find the code for target coin name in Vebitcoin: %s", errRet)
+		if returnError != nil {
+			return
+		}
+
+		targetCoin, err := jsonparser.GetString(value, "TargetCoinCode")
+		if err != nil {
+			returnError = fmt.Errorf("failed to find the code for target coin name in Vebitcoin: %s", err)
+			return
 		}
 		if targetCoin == "TRY" {
-			sourceCoin, errRet := jsonparser.GetString(value, "SourceCoinCode")
-			if errRet != nil {
-				err = fmt.Errorf("failed to find the code for source coin name in Vebitcoin: %s", errRet)
+			sourceCoin, err := jsonparser.GetString(value, "SourceCoinCode")
+			if err != nil {
+				returnError = fmt.Errorf("failed to find the code for source coin name in Vebitcoin: %s", err)
+				return
 			}
 			// Vebitcoin has a bug in their API, the ask price is given in the "Bid" field, bid price is given in their
 			// "Ask" field.
-			pAsk, errRet := jsonparser.GetFloat(value, "Ask")
-			if errRet != nil {
-				err = fmt.Errorf("failed to find the ask price for %s in Vebitcoin: %s", sourceCoin, errRet)
+			pAsk, err := jsonparser.GetFloat(value, "Ask")
+			if err != nil {
+				returnError = fmt.Errorf("failed to find the ask price for %s in Vebitcoin: %s", sourceCoin, err)
+				return
 			}
-			pBid, errRet := jsonparser.GetFloat(value, "Bid")
-			if errRet != nil {
-				err = fmt.Errorf("failed to find the bid price for %s in Vebitcoin: %s", sourceCoin, errRet)
+			pBid, err := jsonparser.GetFloat(value, "Bid")
+			if err != nil {
+				returnError = fmt.Errorf("failed to find the bid price for %s in Vebitcoin: %s", sourceCoin, err)
+				return
 			}
-			prices = append(prices, Price{Exchange: VEBITCOIN, Currency: "TRY", ID: sourceCoin, Ask: pAsk, Bid: pBid})
+			prices = append(prices, Price{Exchange: VEBITCOIN, Currency: "TRY", ID: sourceCoin, Ask: pAsk, Bid: pBid, ReceivedTime: receivedTime})
 		}
 	})
+	if returnError != nil {
+		return nil, returnError
+	}
 
-	return prices, err
+	return prices, nil
 }
 
 func getBinancePrices() ([]Price, error) {
@@ -346,29 +383,31 @@ func getBinancePrices() ([]Price, error) {
 		var uri string
 		uri = fmt.Sprintf(BINANCE_URI, currency, "TRY")
 
-		response, err := http.Get(uri)
+		responseData, err := getClient(BINANCE).get(uri)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get Binance response : %s", err)
 		}
-
-		responseData, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read Binance response data : %s", err)
-		}
+		receivedTime := clockNow()
 
 		priceAsk, err := jsonparser.GetString(responseData, "askPrice")
 		if err != nil {
 			return nil, fmt.Errorf("failed to read the ask price from the Binance response data: %s", err)
 		}
-		pAsk, _ := strconv.ParseFloat(priceAsk, 64)
+		pAsk, err := strconv.ParseFloat(priceAsk, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the %s ask price from the Binance response data: %s", currency, err)
+		}
 
 		priceBid, err := jsonparser.GetString(responseData, "bidPrice")
 		if err != nil {
 			return nil, fmt.Errorf("failed to read the bid price from the Binance response data: %s", err)
 		}
-		pBid, _ := strconv.ParseFloat(priceBid, 64)
+		pBid, err := strconv.ParseFloat(priceBid, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the %s bid price from the Binance response data: %s", currency, err)
+		}
 
-		prices = append(prices, Price{Exchange: BINANCE, Currency: "TRY", ID: currency, Ask: pAsk, Bid: pBid})
+		prices = append(prices, Price{Exchange: BINANCE, Currency: "TRY", ID: currency, Ask: pAsk, Bid: pBid, ReceivedTime: receivedTime})
 
 
 		/*mux.Lock()
@@ -379,34 +418,48 @@ func getBinancePrices() ([]Price, error) {
 	return prices, nil
 }
 
+// getBitfinexPrices reads every pair with a single tickers request. Each ticker is an array that starts with
+// [SYMBOL, BID, BID_SIZE, ASK, ...].
 func getBitfinexPrices() ([]Price, error) {
-	prices := []Price{}
-
+	var symbols []string
 	for _, currency := range bitfinexCurrencies {
-		uri := fmt.Sprintf(BITFINEX_URI, currency)
-		response, err := http.Get(uri)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get Bitfinex response : %s", err)
-		}
+		symbols = append(symbols, "t"+currency+"USD")
+	}
+
+	responseData, err := getClient(BITFINEX).get(fmt.Sprintf(BITFINEX_URI, strings.Join(symbols, ",")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Bitfinex response : %s", err)
+	}
+	receivedTime := clockNow()
 
-		responseData, err := ioutil.ReadAll(response.Body)
+	var prices []Price
+	var returnError error
+	jsonparser.ArrayEach(responseData, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		symbol, err := jsonparser.GetString(value, "[0]")
 		if err != nil {
-			return nil, fmt.Errorf("failed to read Bitfinex response data : %s", err)
+			returnError = fmt.Errorf("failed to read the symbol from the Bitfinex response data: %s", err)
+			return
 		}
+		currency := strings.TrimSuffix(strings.TrimPrefix(symbol, "t"), "USD")
 
-		priceAsk, err := jsonparser.GetString(responseData, "ask")
+		pBid, err := jsonparser.GetFloat(value, "[1]")
 		if err != nil {
-			return nil, fmt.Errorf("failed to read the ask price from the Bitfinex response data: %s", err)
+			returnError = fmt.Errorf("failed to read the %s bid price from the Bitfinex response data: %s", currency, err)
+			return
 		}
-		pAsk, _ := strconv.ParseFloat(priceAsk, 64)
-
-		priceBid, err := jsonparser.GetString(responseData, "bid")
+		pAsk, err := jsonparser.GetFloat(value, "[3]")
 		if err != nil {
-			return nil, fmt.Errorf("failed to read the bid price from the Bitfinex response data: %s", err)
+			returnError = fmt.Errorf("failed to read the %s ask price from the Bitfinex response data: %s", currency, err)
+			return
 		}
-		pBid, _ := strconv.ParseFloat(priceBid, 64)
 
-		prices = append(prices, Price{Exchange: BITFINEX, Currency: "USD", ID: currency, Ask: pAsk, Bid: pBid})
+		volume, _ := jsonparser.GetFloat(value, "[8]")
+
+		prices = append(prices, Price{Exchange: BITFINEX, Currency: "USD", ID: currency, Ask: pAsk, Bid: pBid, Volume: volume,
+			ReceivedTime: receivedTime})
+	})
+	if returnError != nil {
+		return nil, returnError
 	}
 
 	return prices, nil
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buger/jsonparser"
+	ws "github.com/gorilla/websocket"
+)
+
+const (
+	FAKE_EXCHANGE_DATA = "testdata/fakeexchange"
+	FAKE_API_KEY       = "fake-apilayer-key"
+	// FAKE_FRAME_INTERVAL is how often the recorded websocket frames are sent again, so the feeds never go silent.
+	FAKE_FRAME_INTERVAL = 100 * time.Millisecond
+)
+
+// fakeExchange serves the recorded payloads of testdata/fakeexchange. Every venue is mounted below its own path
+// prefix, the base URL its client is pointed at, and keeps the paths of the production API below it. Websocket
+// endpoints replay their recorded frames for as long as the connection stays open.
+type fakeExchange struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu       sync.Mutex
+	messages []url.Values
+}
+
+func newFakeExchange(t *testing.T) *fakeExchange {
+	f := &fakeExchange{t: t}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/paribu/ticker", f.serveFile("paribu/ticker.json"))
+	mux.HandleFunc("/paribu/ws", f.serveFrames("paribu/ws.jsonl"))
+	mux.HandleFunc("/paribu/app/markets/", f.serveParibuMarket)
+	mux.HandleFunc("/btcturk/api/v2/ticker", f.serveFile("btcturk/ticker.json"))
+	mux.HandleFunc("/btcturk/api/v2/orderbook", f.serveEntry("btcturk/orderbook.json", "pairSymbol"))
+	mux.HandleFunc("/btcturk/", f.serveFrames("btcturk/ws.jsonl"))
+	mux.HandleFunc("/binance/api/v3/ticker/bookTicker", f.serveEntry("binance/bookTicker.json", "symbol"))
+	mux.HandleFunc("/binance/api/v3/depth", f.serveEntry("binance/depth.json", "symbol"))
+	mux.HandleFunc("/binance/stream", f.serveFrames("binance/ws.jsonl"))
+	mux.HandleFunc("/koinim/api/v1/ticker/", f.serveKoinim)
+	mux.HandleFunc("/coinbasepro", f.serveFrames("coinbasepro/ws.jsonl"))
+	mux.HandleFunc("/apilayer/exchangerates_data/latest", f.serveRates)
+	mux.HandleFunc("/pushover/1/messages.json", f.servePushover)
+
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// url is the base URL of a venue on the fake exchange.
+func (f *fakeExchange) url(venue string) string {
+	return f.server.URL + "/" + venue
+}
+
+func (f *fakeExchange) read(name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join(FAKE_EXCHANGE_DATA, name))
+	if err != nil {
+		f.t.Errorf("failed to read recorded payload %s : %s", name, err)
+	}
+	return data
+}
+
+func (f *fakeExchange) serveFile(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(f.read(name))
+	}
+}
+
+// serveEntry serves the entry of a recorded object keyed by a query parameter, one entry per market.
+func (f *fakeExchange) serveEntry(name, parameter string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.writeEntry(w, name, r.URL.Query().Get(parameter))
+	}
+}
+
+// serveKoinim serves /api/v1/ticker/<SYMBOL>_TRY/.
+func (f *fakeExchange) serveKoinim(w http.ResponseWriter, r *http.Request) {
+	market := strings.Trim(strings.TrimPrefix(r.URL.Path, "/koinim/api/v1/ticker/"), "/")
+	f.writeEntry(w, "koinim/ticker.json", strings.TrimSuffix(market, "_TRY"))
+}
+
+// serveParibuMarket serves /app/markets/<symbol>-tl.
+func (f *fakeExchange) serveParibuMarket(w http.ResponseWriter, r *http.Request) {
+	market := strings.TrimPrefix(r.URL.Path, "/paribu/app/markets/")
+	f.writeEntry(w, "paribu/markets.json", strings.TrimSuffix(market, "-tl"))
+}
+
+func (f *fakeExchange) writeEntry(w http.ResponseWriter, name, key string) {
+	entry, _, _, err := jsonparser.Get(f.read(name), key)
+	if key == "" || err != nil {
+		http.Error(w, "unknown market", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(entry)
+}
+
+// serveRates only answers requests carrying the API key, like the real provider.
+func (f *fakeExchange) serveRates(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("apikey") != FAKE_API_KEY {
+		http.Error(w, `{"message": "Invalid authentication credentials"}`, http.StatusUnauthorized)
+		return
+	}
+	f.serveFile("apilayer/latest.json")(w, r)
+}
+
+func (f *fakeExchange) servePushover(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Method != http.MethodPost {
+		http.Error(w, `{"status": 0}`, http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	f.messages = append(f.messages, r.PostForm)
+	f.mu.Unlock()
+	w.Write([]byte(`{"status": 1, "request": "fake"}`))
+}
+
+// sentMessages returns the Pushover messages received so far.
+func (f *fakeExchange) sentMessages() []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]url.Values(nil), f.messages...)
+}
+
+// serveFrames upgrades to a websocket and replays the recorded frames, one JSON frame per line, until the client
+// goes away. Subscriptions sent by the client are read and ignored.
+func (f *fakeExchange) serveFrames(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var frames [][]byte
+		scanner := bufio.NewScanner(bytes.NewReader(f.read(name)))
+		for scanner.Scan() {
+			if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+				frames = append(frames, append([]byte(nil), line...))
+			}
+		}
+
+		upgrader := ws.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		ticker := time.NewTicker(FAKE_FRAME_INTERVAL)
+		defer ticker.Stop()
+		for {
+			for _, frame := range frames {
+				if err := conn.WriteMessage(ws.TextMessage, frame); err != nil {
+					return
+				}
+			}
+			select {
+			case <-closed:
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+)
+
+const (
+	FEED_CONNECTING   = "connecting"
+	FEED_CONNECTED    = "connected"
+	FEED_DISCONNECTED = "disconnected"
+
+	WS_HANDSHAKE_TIMEOUT = 10 * time.Second
+	WS_MIN_BACKOFF       = 1 * time.Second
+	WS_MAX_BACKOFF       = 1 * time.Minute
+	WS_STABLE_DURATION   = 1 * time.Minute
+)
+
+// FeedStatus is the connection state of a websocket feed as shown on the dashboard.
+type FeedStatus struct {
+	Name        string
+	State       string
+	Since       time.Time
+	LastMessage time.Time
+	Reconnects  int
+	LastError   string
+}
+
+// wsFeed keeps a websocket subscription alive. It dials, subscribes and reads until the connection fails or stays
+// silent for longer than silenceTimeout, then reports the feed as down and reconnects with exponential backoff.
+type wsFeed struct {
+	name           string
+	uri            string
+	silenceTimeout time.Duration
+	subscribe      func(conn *ws.Conn) error
+	handle         func(data []byte) error
+	onDown         func()
+
+	mu     sync.Mutex
+	status FeedStatus
+}
+
+var (
+	feeds   = map[string]*wsFeed{}
+	feedMux sync.Mutex
+)
+
+func registerFeed(feed *wsFeed) *wsFeed {
+	feed.status = FeedStatus{Name: feed.name, State: FEED_DISCONNECTED, Since: clockNow()}
+
+	feedMux.Lock()
+	feeds[feed.name] = feed
+	feedMux.Unlock()
+	return feed
+}
+
+func feedStatuses() []FeedStatus {
+	feedMux.Lock()
+	defer feedMux.Unlock()
+
+	var statuses []FeedStatus
+	for _, feed := range feeds {
+		statuses = append(statuses, feed.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+func feedConnected(name string) bool {
+	feedMux.Lock()
+	feed, ok := feeds[name]
+	feedMux.Unlock()
+
+	return ok && feed.Status().State == FEED_CONNECTED
+}
+
+func (f *wsFeed) Status() FeedStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+// run keeps the feed connected until ctx is cancelled.
+func (f *wsFeed) run(ctx context.Context) {
+	backoff := WS_MIN_BACKOFF
+	for {
+		connectedAt := clockNow()
+		err := f.connectAndRead(ctx)
+		if ctx.Err() != nil {
+			f.setState(FEED_DISCONNECTED)
+			return
+		}
+		f.setDown(err)
+
+		if clockSince(connectedAt) > WS_STABLE_DURATION {
+			backoff = WS_MIN_BACKOFF
+		}
+		if !sleepContext(ctx, backoff/2+time.Duration(rand.Int63n(int64(backoff)))) {
+			f.setState(FEED_DISCONNECTED)
+			return
+		}
+		if backoff *= 2; backoff > WS_MAX_BACKOFF {
+			backoff = WS_MAX_BACKOFF
+		}
+	}
+}
+
+func (f *wsFeed) connectAndRead(ctx context.Context) error {
+	f.setState(FEED_CONNECTING)
+
+	dialer := ws.Dialer{HandshakeTimeout: WS_HANDSHAKE_TIMEOUT}
+	conn, _, err := dialer.DialContext(ctx, endpoint(f.name, f.uri), nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the %s websocket : %s", f.name, err)
+	}
+	defer conn.Close()
+
+	// On shutdown the connection is closed with a close frame, which also ends the blocked read below. The frame
+	// being handled when that happens is completed first.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			message := ws.FormatCloseMessage(ws.CloseNormalClosure, "shutting down")
+			conn.WriteControl(ws.CloseMessage, message, time.Now().Add(time.Second))
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := f.subscribe(conn); err != nil {
+		return fmt.Errorf("failed to subscribe to the %s websocket : %s", f.name, err)
+	}
+	f.setState(FEED_CONNECTED)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(f.silenceTimeout))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("cannot read %s websocket messages : %s", f.name, err)
+		}
+
+		f.mu.Lock()
+		f.status.LastMessage = clockNow()
+		f.mu.Unlock()
+		capture.recordFrame(f.name, f.uri, data)
+
+		if err := f.handle(data); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *wsFeed) setState(state string) {
+	f.mu.Lock()
+	f.status.State = state
+	f.status.Since = clockNow()
+	f.mu.Unlock()
+}
+
+func (f *wsFeed) setDown(err error) {
+	f.mu.Lock()
+	f.status.State = FEED_DISCONNECTED
+	f.status.Since = clockNow()
+	f.status.Reconnects++
+	f.status.LastError = err.Error()
+	f.mu.Unlock()
+
+	feedLog.Warn("feed disconnected", "exchange", f.name, "error", err)
+
+	if f.onDown != nil {
+		f.onDown()
+	}
+}
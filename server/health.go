@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// MAX_DIFF_LOOP_SILENCE is how long the diff loop may go without a pass before the process counts as dead. The
+	// loop passes at least every MAX_SWEEP_INTERVAL, so a longer silence means it is stuck.
+	MAX_DIFF_LOOP_SILENCE = 30 * time.Second
+
+	// DEFAULT_MAX_FX_AGE allows one missed rate fetch, rates are fetched every 6 hours.
+	DEFAULT_MAX_FX_AGE       = 13 * time.Hour
+	DEFAULT_MIN_TRY_VENUES   = 2
+	READINESS_CORRIDOR       = "TRY"
+	HEALTH_STATUS_OK         = "ok"
+	HEALTH_STATUS_FAILING    = "failing"
+	READINESS_STATUS_READY   = "ready"
+	READINESS_STATUS_UNREADY = "not ready"
+)
+
+var (
+	// maxFXAge and minTRYVenues are the readiness thresholds, set with READY_MAX_FX_AGE and READY_MIN_TRY_VENUES.
+	maxFXAge     = DEFAULT_MAX_FX_AGE
+	minTRYVenues = DEFAULT_MIN_TRY_VENUES
+)
+
+func init() {
+	if value := os.Getenv("READY_MAX_FX_AGE"); value != "" {
+		if age, err := time.ParseDuration(value); err != nil || age <= 0 {
+			configLog.Warn("invalid setting", "name", "READY_MAX_FX_AGE", "value", value)
+		} else {
+			maxFXAge = age
+		}
+	}
+
+	if value := os.Getenv("READY_MIN_TRY_VENUES"); value != "" {
+		if count, err := strconv.Atoi(value); err != nil || count < 0 {
+			configLog.Warn("invalid setting", "name", "READY_MIN_TRY_VENUES", "value", value)
+		} else {
+			minTRYVenues = count
+		}
+	}
+}
+
+// DependencyCheck is the state of one dependency of the readiness check.
+type DependencyCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// Healthz is the liveness check: the process is alive as long as the diff loop keeps running. It does not look
+// at the venues, a dead feed is no reason to restart the process.
+func Healthz(c *gin.Context) {
+	status, code := HEALTH_STATUS_OK, http.StatusOK
+	detail := "diff loop has not run yet"
+	if last := atomic.LoadInt64(&lastDiffPass); last != 0 {
+		silence := time.Since(time.Unix(0, last))
+		detail = fmt.Sprintf("last diff pass %s ago", silence.Round(time.Millisecond))
+		if silence > MAX_DIFF_LOOP_SILENCE {
+			status, code = HEALTH_STATUS_FAILING, http.StatusServiceUnavailable
+		}
+	}
+
+	c.JSON(code, gin.H{
+		"status": status,
+		"detail": detail,
+	})
+}
+
+// Readyz is the readiness check: diffs are only meaningful with a fresh FX rate, a live reference and enough
+// TRY venues with fresh quotes.
+func Readyz(c *gin.Context) {
+	snapshot := market.snapshot()
+	now := clockNow()
+
+	checks := map[string]DependencyCheck{
+		"fx":        fxCheck(snapshot, now),
+		"reference": referenceCheck(snapshot),
+		"venues":    venuesCheck(snapshot, now),
+	}
+
+	status, code := READINESS_STATUS_READY, http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			status, code = READINESS_STATUS_UNREADY, http.StatusServiceUnavailable
+		}
+	}
+
+	c.JSON(code, gin.H{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+func fxCheck(snapshot *marketSnapshot, now time.Time) DependencyCheck {
+	// Every corridor rate is judged by its own age, a fetch that read only some of them leaves the others stale.
+	var oldest time.Duration
+	for _, fiat := range corridors {
+		if snapshot.rate(fiat) == 0 {
+			return DependencyCheck{Detail: fmt.Sprintf("no %s rate", fiat)}
+		}
+		age := now.Sub(snapshot.RateTimes[fiat])
+		if age > maxFXAge {
+			return DependencyCheck{Detail: fmt.Sprintf("%s rate is %s old, more than %s", fiat, formatAge(age), maxFXAge)}
+		}
+		if age > oldest {
+			oldest = age
+		}
+	}
+	return DependencyCheck{OK: true, Detail: fmt.Sprintf("%s rate %.4f, rates at most %s old", READINESS_CORRIDOR,
+		snapshot.rate(READINESS_CORRIDOR), formatAge(oldest))}
+}
+
+// referenceCheck requires the Coinbase Pro feed, or with the composite reference at least one composite price.
+func referenceCheck(snapshot *marketSnapshot) DependencyCheck {
+	if feedConnected(GDAX) {
+		return DependencyCheck{OK: true, Detail: fmt.Sprintf("%s feed connected", GDAX)}
+	}
+	if referenceSource == REFERENCE_COMPOSITE && len(snapshot.Composite) > 0 {
+		return DependencyCheck{OK: true, Detail: fmt.Sprintf("%s feed down, composite of %d symbols", GDAX, len(snapshot.Composite))}
+	}
+	return DependencyCheck{Detail: fmt.Sprintf("%s feed down and no composite reference", GDAX)}
+}
+
+func venuesCheck(snapshot *marketSnapshot, now time.Time) DependencyCheck {
+	healthy := 0
+	for exchange, list := range snapshot.Quotes {
+		if !adapterEnabled(exchange) {
+			continue
+		}
+		for _, p := range list {
+			if p.Currency == READINESS_CORRIDOR && !p.Stale(now) {
+				healthy++
+				break
+			}
+		}
+	}
+
+	detail := fmt.Sprintf("%d %s venues with fresh quotes, %d needed", healthy, READINESS_CORRIDOR, minTRYVenues)
+	return DependencyCheck{OK: healthy >= minTRYVenues, Detail: detail}
+}
@@ -0,0 +1,388 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FX_PROVIDER = "apilayer"
+	PUSHOVER    = "Pushover"
+
+	MAX_RESPONSE_SIZE      = 10 << 20
+	BREAKER_FAILURE_LIMIT  = 5
+	BREAKER_OPEN_DURATION  = 30 * time.Second
+	DEFAULT_CLIENT_TIMEOUT = 5 * time.Second
+	DEFAULT_RETRY_BACKOFF  = 250 * time.Millisecond
+	MAX_RETRY_BACKOFF      = 5 * time.Second
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// clientConfig describes how an exchange may be called: how long a request may take, how many requests per
+// second the venue tolerates and how many times a failed request is retried.
+type clientConfig struct {
+	Timeout       time.Duration
+	RatePerSecond float64
+	Burst         int
+	Retries       int
+}
+
+var (
+	clientConfigs = map[string]clientConfig{
+		PARIBU:      {Timeout: 5 * time.Second, RatePerSecond: 1, Burst: 2, Retries: 2},
+		BTCTURK:     {Timeout: 5 * time.Second, RatePerSecond: 1, Burst: 2, Retries: 2},
+		KOINIM:      {Timeout: 5 * time.Second, RatePerSecond: 5, Burst: 6, Retries: 1},
+		KOINEKS:     {Timeout: 5 * time.Second, RatePerSecond: 5, Burst: 15, Retries: 1},
+		VEBITCOIN:   {Timeout: 5 * time.Second, RatePerSecond: 1, Burst: 2, Retries: 2},
+		BINANCE:     {Timeout: 5 * time.Second, RatePerSecond: 10, Burst: 10, Retries: 2},
+		BITTREX:     {Timeout: 10 * time.Second, RatePerSecond: 1, Burst: 3, Retries: 2},
+		BITFINEX:    {Timeout: 5 * time.Second, RatePerSecond: 0.5, Burst: 4, Retries: 1},
+		BITOASIS:    {Timeout: 5 * time.Second, RatePerSecond: 3, Burst: 6, Retries: 1},
+		KRAKEN:      {Timeout: 5 * time.Second, RatePerSecond: 0.5, Burst: 2, Retries: 1},
+		BITSTAMP:    {Timeout: 5 * time.Second, RatePerSecond: 5, Burst: 12, Retries: 1},
+		FX_PROVIDER: {Timeout: 15 * time.Second, RatePerSecond: 0.1, Burst: 1, Retries: 3},
+		PUSHOVER:    {Timeout: 10 * time.Second, RatePerSecond: 1, Burst: 5, Retries: 0},
+		// The USDT markets feed the composite index, the default reference. They get a breaker of their own so
+		// failures of the TRY polls or depth fetches do not take the reference down with them.
+		BINANCE_USDT: {Timeout: 5 * time.Second, RatePerSecond: 2, Burst: 4, Retries: 2},
+	}
+
+	clients   = map[string]*exchangeClient{}
+	clientMux sync.Mutex
+
+	// requestCtx is the context of the polling requests, cancelled on shutdown so no loop waits for a venue.
+	// Notifications build their own requests and are still sent while shutting down.
+	requestCtx = context.Background()
+
+	// baseURLs point a client or websocket feed at another host than the production one, for a staging venue or a
+	// fake exchange. They are set with <NAME>_BASE_URL, e.g. PARIBU_BASE_URL=http://localhost:8081/paribu.
+	baseURLs   = map[string]*url.URL{}
+	baseURLMux sync.Mutex
+	// fallbackBaseURL, when set, takes every name without a base URL of its own to <fallbackBaseURL>/<name>.
+	fallbackBaseURL *url.URL
+)
+
+func init() {
+	names := []string{GDAX}
+	for name := range clientConfigs {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		variable := exchangeVariable(name, "BASE_URL")
+		if value := os.Getenv(variable); value != "" {
+			if err := setBaseURL(name, value); err != nil {
+				configLog.Warn("invalid setting", "name", variable, "value", value, "error", err)
+			}
+		}
+	}
+}
+
+// setBaseURL sends the requests of name to base instead, an empty base restores the production host.
+func setBaseURL(name, base string) error {
+	baseURLMux.Lock()
+	defer baseURLMux.Unlock()
+
+	if base == "" {
+		delete(baseURLs, name)
+		return nil
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return fmt.Errorf("failed to parse base URL %s : %s", base, err)
+	}
+	if u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("failed to parse base URL %s : expected an http or https URL", base)
+	}
+	baseURLs[name] = u
+	return nil
+}
+
+// redirectAllBaseURLs sends every client and feed to <base>/<name>, replacing the base URLs set so far. It is how a
+// replay keeps the whole server off the network.
+func redirectAllBaseURLs(base *url.URL) {
+	baseURLMux.Lock()
+	baseURLs = map[string]*url.URL{}
+	fallbackBaseURL = base
+	baseURLMux.Unlock()
+}
+
+// rebase moves uri onto the base URL of name, keeping its path below the base path. Websocket URIs keep their
+// scheme family, an http base becomes ws and an https one wss.
+func rebase(name string, uri *url.URL) *url.URL {
+	baseURLMux.Lock()
+	base, ok := baseURLs[name]
+	if !ok && fallbackBaseURL != nil {
+		base, ok = fallbackBaseURL.JoinPath(name), true
+	}
+	baseURLMux.Unlock()
+	if !ok {
+		return uri
+	}
+
+	rebased := *uri
+	rebased.Scheme, rebased.Host = base.Scheme, base.Host
+	if uri.Scheme == "ws" || uri.Scheme == "wss" {
+		rebased.Scheme = map[string]string{"http": "ws", "https": "wss"}[base.Scheme]
+	}
+	rebased.Path = strings.TrimSuffix(base.Path, "/") + uri.Path
+	rebased.RawPath = ""
+	return &rebased
+}
+
+// endpoint is rebase for URIs given as strings. A URI that does not parse is returned as it is, the request on it
+// fails with the parse error.
+func endpoint(name, uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return rebase(name, u).String()
+}
+
+func setRequestContext(ctx context.Context) {
+	clientMux.Lock()
+	requestCtx = ctx
+	clientMux.Unlock()
+}
+
+func requestContext() context.Context {
+	clientMux.Lock()
+	defer clientMux.Unlock()
+	return requestCtx
+}
+
+// exchangeClient is the HTTP client every adapter goes through. It bounds each request with a timeout, paces
+// requests with a token bucket, retries transient failures with jittered backoff and stops calling a venue for a
+// while once it keeps failing.
+type exchangeClient struct {
+	name    string
+	client  *http.Client
+	limiter *tokenBucket
+	breaker *circuitBreaker
+	retries int
+}
+
+func getClient(name string) *exchangeClient {
+	clientMux.Lock()
+	defer clientMux.Unlock()
+
+	client, ok := clients[name]
+	if !ok {
+		config, ok := clientConfigs[name]
+		if !ok {
+			config = clientConfig{Timeout: DEFAULT_CLIENT_TIMEOUT, RatePerSecond: 1, Burst: 1, Retries: 1}
+		}
+		client = newExchangeClient(name, config)
+		clients[name] = client
+	}
+	return client
+}
+
+func newExchangeClient(name string, config clientConfig) *exchangeClient {
+	return &exchangeClient{
+		name:    name,
+		client:  &http.Client{Timeout: config.Timeout},
+		limiter: newTokenBucket(config.RatePerSecond, config.Burst),
+		breaker: &circuitBreaker{failureLimit: BREAKER_FAILURE_LIMIT, openDuration: BREAKER_OPEN_DURATION},
+		retries: config.Retries,
+	}
+}
+
+func (c *exchangeClient) get(uri string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(requestContext(), http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create %s request : %s", c.name, err)
+	}
+	return c.do(req)
+}
+
+// do sends the request and returns the response body of a 2xx response. Requests with a body are only retried
+// when the request can recreate it through GetBody. A cancelled request context stops the retries and does not
+// count against the circuit breaker. Neither does a response the venue answered with a client error, a 400 for a
+// delisted symbol says nothing about the other paths of the venue. Only the failures worth retrying do.
+func (c *exchangeClient) do(req *http.Request) ([]byte, error) {
+	source := req.URL.String()
+	req.URL = rebase(c.name, req.URL)
+	req.Host = req.URL.Host
+
+	allowed, probe := c.breaker.allow()
+	if !allowed {
+		return nil, fmt.Errorf("%s : %s", c.name, errCircuitOpen)
+	}
+	if probe {
+		// A probe cut short by a cancelled context neither closes the breaker nor keeps it open, the next request
+		// probes again.
+		defer c.breaker.release()
+	}
+
+	var lastErr error
+	retryable := true
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			if req.Body != nil {
+				if req.GetBody == nil {
+					break
+				}
+				body, err := req.GetBody()
+				if err != nil {
+					break
+				}
+				req.Body = body
+			}
+			if !sleepOn(req.Context(), wallClock{}, retryBackoff(attempt)) {
+				return nil, fmt.Errorf("%s request to %s cancelled : %s", c.name, req.URL.Path, req.Context().Err())
+			}
+		}
+
+		if !c.limiter.wait(req.Context()) {
+			return nil, fmt.Errorf("%s request to %s cancelled : %s", c.name, req.URL.Path, req.Context().Err())
+		}
+		data, retry, err := c.send(req, source)
+		if err == nil {
+			c.breaker.success()
+			return data, nil
+		}
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+
+		lastErr, retryable = err, retry
+		if !retry {
+			break
+		}
+	}
+
+	if retryable {
+		c.breaker.failure()
+	}
+	return nil, lastErr
+}
+
+// send sends the request once. source is the URL before rebasing, the one the response is captured under.
+func (c *exchangeClient) send(req *http.Request, source string) (data []byte, retry bool, err error) {
+	response, err := c.client.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("%s request to %s failed : %s", c.name, req.URL.Path, err)
+	}
+	defer response.Body.Close()
+
+	data, err = ioutil.ReadAll(io.LimitReader(response.Body, MAX_RESPONSE_SIZE))
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to read %s response body : %s", c.name, err)
+	}
+	capture.recordResponse(c.name, req.Method, source, response.StatusCode, data)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		retry = response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+		return nil, retry, fmt.Errorf("%s returned status %s for %s", c.name, response.Status, req.URL.Path)
+	}
+
+	return data, false, nil
+}
+
+func retryBackoff(attempt int) time.Duration {
+	backoff := DEFAULT_RETRY_BACKOFF << uint(attempt-1)
+	if backoff > MAX_RETRY_BACKOFF {
+		backoff = MAX_RETRY_BACKOFF
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(ratePerSecond float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: ratePerSecond, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait blocks until a token is available and takes it. It gives up, returning false, when ctx is cancelled first.
+func (b *tokenBucket) wait(ctx context.Context) bool {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return true
+		}
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		if !sleepOn(ctx, wallClock{}, delay) {
+			return false
+		}
+	}
+}
+
+// circuitBreaker opens after failureLimit consecutive failures and lets a single probe through once openDuration
+// has passed. A successful probe closes it again, a failed one keeps it open for another openDuration.
+type circuitBreaker struct {
+	mu           sync.Mutex
+	failureLimit int
+	openDuration time.Duration
+	failures     int
+	openedAt     time.Time
+	probing      bool
+}
+
+// allow reports whether a request may be sent and whether it is the probe of an open breaker. The probe must end
+// with success, failure or release.
+func (b *circuitBreaker) allow() (allowed, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.failureLimit {
+		return true, false
+	}
+	if b.probing || time.Since(b.openedAt) < b.openDuration {
+		return false, false
+	}
+	b.probing = true
+	return true, true
+}
+
+// release ends a probe that was neither a success nor a failure. It does nothing once the probe has ended.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	b.failures = 0
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	b.failures++
+	if b.failures >= b.failureLimit {
+		b.openedAt = time.Now()
+	}
+	b.probing = false
+	b.mu.Unlock()
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// getTest sends a GET through client on its own context, the request context of the server is cancelled by the end
+// to end test.
+func getTest(client *exchangeClient, uri string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.do(req)
+}
+
+// TestClientBreaker checks which outcomes of a request count against the circuit breaker and are retried: transport
+// errors, 429 and 5xx do, client errors the venue answered with do not.
+func TestClientBreaker(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		retries  int
+		requests int32
+		failures int
+	}{
+		{name: "ok", status: http.StatusOK, requests: 1},
+		{name: "bad request", status: http.StatusBadRequest, retries: 1, requests: 1},
+		{name: "not found", status: http.StatusNotFound, retries: 1, requests: 1},
+		{name: "too many requests", status: http.StatusTooManyRequests, requests: 1, failures: 1},
+		{name: "server error", status: http.StatusInternalServerError, requests: 1, failures: 1},
+		{name: "server error retried", status: http.StatusServiceUnavailable, retries: 1, requests: 2, failures: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			config := clientConfig{Timeout: DEFAULT_CLIENT_TIMEOUT, RatePerSecond: 100, Burst: 10, Retries: test.retries}
+			client := newExchangeClient("test", config)
+			getTest(client, server.URL)
+			if got := atomic.LoadInt32(&requests); got != test.requests {
+				t.Errorf("expected %d requests, got %d", test.requests, got)
+			}
+			if client.breaker.failures != test.failures {
+				t.Errorf("expected %d breaker failures, got %d", test.failures, client.breaker.failures)
+			}
+		})
+	}
+
+	t.Run("transport error", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+
+		client := newExchangeClient("test", clientConfig{Timeout: DEFAULT_CLIENT_TIMEOUT, RatePerSecond: 100, Burst: 10})
+		if _, err := getTest(client, server.URL); err == nil {
+			t.Fatal("expected the request to a closed server to fail")
+		}
+		if client.breaker.failures != 1 {
+			t.Errorf("expected 1 breaker failure, got %d", client.breaker.failures)
+		}
+	})
+}
+
+// TestClientBreakerOpens checks that a venue failing BREAKER_FAILURE_LIMIT times in a row is not called any more,
+// while any number of client errors leaves it open to requests.
+func TestClientBreakerOpens(t *testing.T) {
+	status := int32(http.StatusNotFound)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	client := newExchangeClient("test", clientConfig{Timeout: DEFAULT_CLIENT_TIMEOUT, RatePerSecond: 100, Burst: 20})
+	for i := 0; i < 2*BREAKER_FAILURE_LIMIT; i++ {
+		getTest(client, server.URL)
+	}
+	if allowed, _ := client.breaker.allow(); !allowed {
+		t.Fatal("expected client errors to leave the breaker closed")
+	}
+
+	atomic.StoreInt32(&status, http.StatusBadGateway)
+	for i := 0; i < BREAKER_FAILURE_LIMIT; i++ {
+		getTest(client, server.URL)
+	}
+	sent := atomic.LoadInt32(&requests)
+	if _, err := getTest(client, server.URL); err == nil || atomic.LoadInt32(&requests) != sent {
+		t.Fatalf("expected the open breaker to stop the request, got %v", err)
+	}
+}
+
+// TestClientBreakerProbeCancelled checks that a probe cut short by its context lets the next request probe again.
+func TestClientBreakerProbeCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client := newExchangeClient("test", clientConfig{Timeout: DEFAULT_CLIENT_TIMEOUT, RatePerSecond: 100, Burst: 10})
+	client.breaker.failures = BREAKER_FAILURE_LIMIT
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if _, err := client.do(req); err == nil {
+		t.Fatal("expected the cancelled probe to fail")
+	}
+	if _, err := getTest(client, server.URL); err != nil {
+		t.Fatalf("expected the next request to probe, got %v", err)
+	}
+	if client.breaker.failures != 0 {
+		t.Errorf("expected the successful probe to close the breaker, got %d failures", client.breaker.failures)
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	FX_OFFICIAL = "official"
+	FX_IMPLIED  = "implied"
+
+	PREMIUM_SAMPLE_INTERVAL = 1 * time.Minute
+	// MAX_PREMIUM_HISTORY keeps a day of samples.
+	MAX_PREMIUM_HISTORY = 1440
+)
+
+var (
+	// impliedSources are the stablecoin books each fiat's implied rate is derived from.
+	impliedSources = map[string][]impliedSource{
+		"TRY": {
+			{Exchange: BTCTURK, Symbol: "USDT"},
+			{Exchange: BTCTURK, Symbol: "USDC"},
+			{Exchange: BINANCE, Symbol: "USDT"},
+			{Exchange: PARIBU, Symbol: "USDT"},
+		},
+	}
+
+	// fxSource selects the rate the reference is converted at, the official rate or the stablecoin-implied one. It
+	// is set with FX_SOURCE. With the implied rate the diffs only show coin specific mispricing, the FX part of the
+	// premium is tracked by the premium index.
+	fxSource = FX_OFFICIAL
+
+	premiumHistory    = map[string][]PremiumPoint{}
+	premiumHistoryMux sync.Mutex
+)
+
+func init() {
+	switch source := os.Getenv("FX_SOURCE"); source {
+	case "":
+	case FX_OFFICIAL, FX_IMPLIED:
+		fxSource = source
+	default:
+		configLog.Warn("invalid setting", "name", "FX_SOURCE", "value", source, "using", fxSource)
+	}
+}
+
+type impliedSource struct {
+	Exchange string
+	Symbol   string
+}
+
+// ImpliedRate is the USD rate of a fiat as local traders see it, the median of the stablecoin mid prices on its
+// venues. USDT prices are corrected by the USDT/USD reference price when it is fresh.
+type ImpliedRate struct {
+	Fiat     string  `json:"fiat"`
+	Rate     float64 `json:"rate"`
+	Official float64 `json:"official"`
+	// Premium is how much more, in percent, a dollar costs through stablecoins than at the official rate.
+	Premium float64             `json:"premium"`
+	Sources []ImpliedRateSource `json:"sources"`
+	Time    time.Time           `json:"time"`
+}
+
+type ImpliedRateSource struct {
+	Exchange string  `json:"exchange"`
+	Symbol   string  `json:"symbol"`
+	Rate     float64 `json:"rate"`
+}
+
+// PremiumPoint is one sample of the premium index.
+type PremiumPoint struct {
+	Time     time.Time `json:"time"`
+	Implied  float64   `json:"implied"`
+	Official float64   `json:"official"`
+	Premium  float64   `json:"premium"`
+}
+
+// calculateImpliedRates derives the implied rate of every fiat with stablecoin sources from the fresh quotes of
+// the snapshot.
+func calculateImpliedRates(snapshot *marketSnapshot, now time.Time, coinbaseLive bool) map[string]ImpliedRate {
+	usdt := 1.0
+	if p, ok := snapshot.Reference["USDT"]; ok && coinbaseLive && !p.Stale(now) && p.Ask > 0 && p.Bid > 0 {
+		usdt = (p.Ask + p.Bid) / 2
+	}
+
+	rates := map[string]ImpliedRate{}
+	for fiat, sources := range impliedSources {
+		implied := ImpliedRate{Fiat: fiat, Official: snapshot.rate(fiat), Time: now}
+
+		var values []float64
+		for _, source := range sources {
+			for _, p := range snapshot.Quotes[source.Exchange] {
+				if p.ID != source.Symbol || p.Currency != fiat || p.Stale(now) || p.Ask <= 0 || p.Bid <= 0 {
+					continue
+				}
+
+				rate := (p.Ask + p.Bid) / 2
+				if source.Symbol == "USDT" {
+					rate /= usdt
+				}
+				values = append(values, rate)
+				implied.Sources = append(implied.Sources, ImpliedRateSource{Exchange: source.Exchange, Symbol: source.Symbol, Rate: Round(rate, .5, 4)})
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		implied.Rate = Round(median(values), .5, 4)
+		if implied.Official != 0 {
+			implied.Premium = Round((implied.Rate/implied.Official-1)*100, .5, 2)
+		}
+		rates[fiat] = implied
+	}
+	return rates
+}
+
+// diffRate is the rate the reference is converted at for a corridor.
+func (s *marketSnapshot) diffRate(fiat string) float64 {
+	if fxSource == FX_IMPLIED {
+		if implied, ok := s.Implied[fiat]; ok {
+			return implied.Rate
+		}
+	}
+	return s.rate(fiat)
+}
+
+// samplePremiumIndex records the premium of every implied rate once per PREMIUM_SAMPLE_INTERVAL.
+func samplePremiumIndex(ctx context.Context) {
+	for sleepContext(ctx, PREMIUM_SAMPLE_INTERVAL) {
+		snapshot := market.snapshot()
+		premiumHistoryMux.Lock()
+		for fiat, implied := range snapshot.Implied {
+			if implied.Official == 0 {
+				continue
+			}
+
+			history := append(premiumHistory[fiat], PremiumPoint{
+				Time:     clockNow(),
+				Implied:  implied.Rate,
+				Official: implied.Official,
+				Premium:  implied.Premium,
+			})
+			if len(history) > MAX_PREMIUM_HISTORY {
+				history = history[len(history)-MAX_PREMIUM_HISTORY:]
+			}
+			premiumHistory[fiat] = history
+		}
+		premiumHistoryMux.Unlock()
+	}
+}
+
+func premiumIndex(fiat string) []PremiumPoint {
+	premiumHistoryMux.Lock()
+	defer premiumHistoryMux.Unlock()
+	return append([]PremiumPoint(nil), premiumHistory[fiat]...)
+}
+
+func GetPremiumIndex(c *gin.Context) {
+	snapshot := market.snapshot()
+
+	var fiats []string
+	for fiat := range impliedSources {
+		fiats = append(fiats, fiat)
+	}
+	sort.Strings(fiats)
+
+	index := map[string]gin.H{}
+	for _, fiat := range fiats {
+		index[fiat] = gin.H{
+			"current": snapshot.Implied[fiat],
+			"history": premiumIndex(fiat),
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"fxSource": fxSource,
+		"index":    index,
+	})
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	BINANCE_USDT_URI = "https://api.binance.com/api/v3/ticker/24hr?symbols=%s"
+
+	// BINANCE_USDT is Binance's global USDT market, a reference venue apart from its TRY market.
+	BINANCE_USDT = "BinanceUSDT"
+
+	DEFAULT_INDEX_OUTLIER_PERCENT = 2.0
+	// MIN_INDEX_OUTLIER_CONSTITUENTS is the number of constituents needed to tell an outlier from the rest.
+	MIN_INDEX_OUTLIER_CONSTITUENTS = 3
+)
+
+var (
+	// indexOutlierPercent is how far, in percent, a constituent's mid may be from the plain median of all mids
+	// before it is left out of the index. It is set with INDEX_OUTLIER_PERCENT.
+	indexOutlierPercent = DEFAULT_INDEX_OUTLIER_PERCENT
+)
+
+func init() {
+	if value := os.Getenv("INDEX_OUTLIER_PERCENT"); value != "" {
+		percent, err := strconv.ParseFloat(value, 64)
+		if err != nil || percent <= 0 {
+			configLog.Warn("invalid setting", "name", "INDEX_OUTLIER_PERCENT", "value", value)
+		} else {
+			indexOutlierPercent = percent
+		}
+	}
+}
+
+// IndexConstituent is a reference venue's quote in USD and its share of the composite index.
+type IndexConstituent struct {
+	Source string  `json:"source"`
+	Ask    float64 `json:"ask"`
+	Bid    float64 `json:"bid"`
+	Mid    float64 `json:"mid"`
+	// VolumeUSD is the venue's 24 hour volume, zero when the venue does not report it.
+	VolumeUSD float64 `json:"volumeUsd"`
+	// Weight is the constituent's share of the index, zero for rejected constituents.
+	Weight   float64 `json:"weight"`
+	Rejected string  `json:"rejected,omitempty"`
+}
+
+func newIndexConstituent(source string, ask, bid, volume float64) IndexConstituent {
+	mid := (ask + bid) / 2
+	return IndexConstituent{Source: source, Ask: ask, Bid: bid, Mid: mid, VolumeUSD: volume * mid}
+}
+
+// buildReferenceIndex computes the composite index of a symbol. Constituents further than indexOutlierPercent
+// from the median mid are rejected, the others are weighted by their USD volume and the index ask and bid are the
+// weighted medians of theirs, an index whose bid ends up above its ask is rejected. Venues that report no volume
+// get the median weight of those that do, or all constituents weigh the same when none does.
+func buildReferenceIndex(symbol string, constituents []IndexConstituent, now time.Time) (Price, []IndexConstituent, bool) {
+	if len(constituents) == 0 {
+		return Price{}, nil, false
+	}
+	constituents = append([]IndexConstituent(nil), constituents...)
+
+	if len(constituents) >= MIN_INDEX_OUTLIER_CONSTITUENTS {
+		var mids []float64
+		for _, c := range constituents {
+			mids = append(mids, c.Mid)
+		}
+		medianMid := median(mids)
+
+		for i, c := range constituents {
+			deviation := (c.Mid - medianMid) * 100 / medianMid
+			if math.Abs(deviation) > indexOutlierPercent {
+				constituents[i].Rejected = fmt.Sprintf("outlier %%%.2f from the median", deviation)
+			}
+		}
+	}
+
+	var volumes []float64
+	for _, c := range constituents {
+		if c.Rejected == "" && c.VolumeUSD > 0 {
+			volumes = append(volumes, c.VolumeUSD)
+		}
+	}
+	defaultWeight := 1.0
+	if len(volumes) > 0 {
+		defaultWeight = median(volumes)
+	}
+
+	total := 0.0
+	for i, c := range constituents {
+		if c.Rejected != "" {
+			continue
+		}
+		constituents[i].Weight = defaultWeight
+		if len(volumes) > 0 && c.VolumeUSD > 0 {
+			constituents[i].Weight = c.VolumeUSD
+		}
+		total += constituents[i].Weight
+	}
+
+	var asks, bids, weights []float64
+	for i, c := range constituents {
+		if c.Rejected != "" {
+			continue
+		}
+		constituents[i].Weight = Round(c.Weight/total, .5, 4)
+		asks = append(asks, c.Ask)
+		bids = append(bids, c.Bid)
+		weights = append(weights, c.Weight)
+	}
+
+	index := Price{Exchange: COMPOSITE, Currency: "USD", ID: symbol, Ask: weightedMedian(asks, weights),
+		Bid: weightedMedian(bids, weights), ReceivedTime: now}
+	// The sides are medians of their own, venues far apart can cross them. No premium is computed from a crossed
+	// index.
+	if index.Bid > index.Ask {
+		validationLog.Warn("composite index crossed", "symbol", symbol, "ask", index.Ask, "bid", index.Bid)
+		return Price{}, constituents, false
+	}
+	return index, constituents, true
+}
+
+// weightedMedian is the value at which half of the total weight lies on either side.
+func weightedMedian(values, weights []float64) float64 {
+	order := make([]int, len(values))
+	total := 0.0
+	for i := range values {
+		order[i] = i
+		total += weights[i]
+	}
+	sort.Slice(order, func(i, j int) bool { return values[order[i]] < values[order[j]] })
+
+	cumulative := 0.0
+	for n, i := range order {
+		cumulative += weights[i]
+		if cumulative*2 > total {
+			return values[i]
+		}
+		// Exactly half the weight below: the median lies between this value and the next.
+		if cumulative*2 == total && n+1 < len(order) {
+			return (values[i] + values[order[n+1]]) / 2
+		}
+	}
+	return values[order[len(order)-1]]
+}
+
+func GetIndex(c *gin.Context) {
+	snapshot := market.snapshot()
+
+	index := map[string]gin.H{}
+	for symbol, price := range snapshot.Composite {
+		index[symbol] = gin.H{
+			"ask":          price.Ask,
+			"bid":          price.Bid,
+			"constituents": snapshot.IndexConstituents[symbol],
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"source":         referenceSource,
+		"outlierPercent": indexOutlierPercent,
+		"index":          index,
+	})
+}
+
+// getBinanceUSDTPrices reads the USDT markets of Binance with one 24 hour ticker request, which also carries the
+// volume the index weights them by.
+func getBinanceUSDTPrices() ([]Price, error) {
+	var symbols []string
+	for _, currency := range binanceCurrencies {
+		if currency != "USDT" {
+			symbols = append(symbols, fmt.Sprintf("%q", currency+"USDT"))
+		}
+	}
+
+	uri := fmt.Sprintf(BINANCE_USDT_URI, url.QueryEscape("["+strings.Join(symbols, ",")+"]"))
+	responseData, err := getClient(BINANCE_USDT).get(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Binance USDT response : %s", err)
+	}
+	receivedTime := clockNow()
+
+	var prices []Price
+	var returnError error
+	jsonparser.ArrayEach(responseData, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		symbol, err := jsonparser.GetString(value, "symbol")
+		if err != nil {
+			returnError = fmt.Errorf("failed to read the symbol from the Binance USDT response data: %s", err)
+			return
+		}
+		id := strings.TrimSuffix(symbol, "USDT")
+
+		pAsk, err := getJSONFloat(value, "askPrice")
+		if err != nil {
+			returnError = fmt.Errorf("failed to read the %s ask price from the Binance USDT response data: %s", id, err)
+			return
+		}
+		pBid, err := getJSONFloat(value, "bidPrice")
+		if err != nil {
+			returnError = fmt.Errorf("failed to read the %s bid price from the Binance USDT response data: %s", id, err)
+			return
+		}
+		volume, _ := getJSONFloat(value, "volume")
+
+		prices = append(prices, Price{Exchange: BINANCE_USDT, Currency: "USDT", ID: id, Ask: pAsk, Bid: pBid, Volume: volume,
+			ReceivedTime: receivedTime})
+	})
+	if returnError != nil {
+		return nil, returnError
+	}
+
+	return prices, nil
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBuildReferenceIndex checks the composite index: outliers are left out, the rest is weighted by volume and a
+// crossed index is rejected.
+func TestBuildReferenceIndex(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		constituents []IndexConstituent
+		ok           bool
+		ask, bid     float64
+		rejected     []string
+	}{
+		{name: "no constituents"},
+		{
+			name:         "single constituent",
+			constituents: []IndexConstituent{newIndexConstituent(GDAX, 101, 100, 0)},
+			ok:           true, ask: 101, bid: 100,
+		},
+		{
+			name: "equal weights without volume",
+			constituents: []IndexConstituent{
+				newIndexConstituent(GDAX, 101, 100, 0),
+				newIndexConstituent(KRAKEN+" USD", 102, 101, 0),
+				newIndexConstituent(BITSTAMP+" USD", 100.5, 99.5, 0),
+			},
+			ok: true, ask: 101, bid: 100,
+		},
+		{
+			name: "outlier rejected",
+			constituents: []IndexConstituent{
+				newIndexConstituent(GDAX, 101, 100, 0),
+				newIndexConstituent(KRAKEN+" USD", 101.5, 100.5, 0),
+				newIndexConstituent(BITSTAMP+" USD", 111, 110, 0),
+			},
+			ok: true, ask: 101.25, bid: 100.25,
+			rejected: []string{BITSTAMP + " USD"},
+		},
+		{
+			name: "weighted by volume",
+			constituents: []IndexConstituent{
+				newIndexConstituent(GDAX, 101, 100, 10),
+				newIndexConstituent(KRAKEN+" USD", 102, 101, 1),
+				newIndexConstituent(BITSTAMP+" USD", 100.5, 99.5, 1),
+			},
+			ok: true, ask: 101, bid: 100,
+		},
+		{
+			// Only crossed constituents can cross the medians, the index must not pass them on.
+			name: "crossed index rejected",
+			constituents: []IndexConstituent{
+				newIndexConstituent(GDAX, 100, 100.2, 0),
+				newIndexConstituent(KRAKEN+" USD", 100.1, 100.3, 0),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index, constituents, ok := buildReferenceIndex("BTC", test.constituents, now)
+			if ok != test.ok {
+				t.Fatalf("expected ok %v, got %v with %+v", test.ok, ok, index)
+			}
+			if ok && (index.Ask != test.ask || index.Bid != test.bid || index.Exchange != COMPOSITE) {
+				t.Errorf("expected %s ask %v bid %v, got %s ask %v bid %v", COMPOSITE, test.ask, test.bid,
+					index.Exchange, index.Ask, index.Bid)
+			}
+
+			rejected := map[string]bool{}
+			for _, source := range test.rejected {
+				rejected[source] = true
+			}
+			for _, c := range constituents {
+				if (c.Rejected != "") != rejected[c.Source] {
+					t.Errorf("%s : expected rejected %v, got %q", c.Source, rejected[c.Source], c.Rejected)
+				}
+				if c.Rejected != "" && c.Weight != 0 {
+					t.Errorf("%s : expected no weight for a rejected constituent, got %v", c.Source, c.Weight)
+				}
+			}
+		})
+	}
+}
+
+func TestWeightedMedian(t *testing.T) {
+	tests := []struct {
+		values, weights []float64
+		expected        float64
+	}{
+		{values: []float64{3, 1, 2}, weights: []float64{1, 1, 1}, expected: 2},
+		{values: []float64{1, 2}, weights: []float64{1, 1}, expected: 1.5},
+		{values: []float64{1, 2, 3}, weights: []float64{1, 1, 5}, expected: 3},
+		{values: []float64{1, 2, 3, 4}, weights: []float64{4, 1, 1, 2}, expected: 1.5},
+	}
+
+	for _, test := range tests {
+		if got := weightedMedian(test.values, test.weights); got != test.expected {
+			t.Errorf("weightedMedian(%v, %v) : expected %v, got %v", test.values, test.weights, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SHUTDOWN_TIMEOUT bounds the whole shutdown, Heroku kills the dyno 30 seconds after SIGTERM.
+const SHUTDOWN_TIMEOUT = 20 * time.Second
+
+// sleepContext waits for d on the server clock or until ctx is cancelled, and reports whether the caller should go
+// on.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	return sleepOn(ctx, currentClock(), d)
+}
+
+// sleepOn is sleepContext on the given clock.
+func sleepOn(ctx context.Context, c clock, d time.Duration) bool {
+	timer, stop := c.newTimer(d)
+	defer stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer:
+		return true
+	}
+}
+
+// loops runs the background loops of the server and waits for them to return once their context is cancelled.
+type loops struct {
+	wg sync.WaitGroup
+}
+
+func (l *loops) start(ctx context.Context, name string, loop func(ctx context.Context)) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		loop(ctx)
+		logger.Debug("loop stopped", "loop", name)
+	}()
+}
+
+// wait waits for every loop to return, or until ctx is done. It reports whether all of them did.
+func (l *loops) wait(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
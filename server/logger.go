@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	LOG_FORMAT_LOGFMT = "logfmt"
+	LOG_FORMAT_JSON   = "json"
+
+	// MAX_RECENT_ERRORS bounds the ring buffer of warnings and errors the dashboard shows.
+	MAX_RECENT_ERRORS = 100
+	// RECENT_ERROR_WINDOW is how long a warning stays on the dashboard, MAX_DASHBOARD_WARNINGS how many are shown.
+	RECENT_ERROR_WINDOW    = 5 * time.Minute
+	MAX_DASHBOARD_WARNINGS = 10
+)
+
+var (
+	// logLevel is the verbosity, set with LOG_LEVEL to debug, info, warn or error. LOG_FORMAT selects logfmt, the
+	// default, or json.
+	logLevel     = new(slog.LevelVar)
+	recentErrors = &errorRing{size: MAX_RECENT_ERRORS}
+	logger       = newLogger(os.Stdout, os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))
+
+	adapterLog    = logger.With("component", "adapters")
+	feedLog       = logger.With("component", "feeds")
+	fxLog         = logger.With("component", "fx")
+	alertLog      = logger.With("component", "alerting")
+	depthLog      = logger.With("component", "depth")
+	validationLog = logger.With("component", "validation")
+	configLog     = logger.With("component", "config")
+	httpLog       = logger.With("component", "http")
+	auditLog      = logger.With("component", "audit")
+	captureLog    = logger.With("component", "capture")
+)
+
+func newLogger(w io.Writer, format, level string) *slog.Logger {
+	var invalid []string
+	switch strings.ToLower(level) {
+	case "":
+	case "debug":
+		logLevel.Set(slog.LevelDebug)
+	case "info":
+		logLevel.Set(slog.LevelInfo)
+	case "warn", "warning":
+		logLevel.Set(slog.LevelWarn)
+	case "error":
+		logLevel.Set(slog.LevelError)
+	default:
+		invalid = append(invalid, "LOG_LEVEL", level)
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", LOG_FORMAT_LOGFMT:
+		handler = slog.NewTextHandler(w, options)
+	case LOG_FORMAT_JSON:
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		handler = slog.NewTextHandler(w, options)
+		invalid = append(invalid, "LOG_FORMAT", format)
+	}
+
+	l := slog.New(&redactingHandler{next: &recordingHandler{next: handler, ring: recentErrors}})
+	for i := 0; i < len(invalid); i += 2 {
+		l.Warn("invalid setting", "component", "config", "name", invalid[i], "value", invalid[i+1])
+	}
+	return l
+}
+
+// RecentError is a warning or error as shown on the dashboard.
+type RecentError struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Component string    `json:"component"`
+	Message   string    `json:"message"`
+}
+
+func (e RecentError) String() string {
+	return fmt.Sprintf("%s %s %s : %s", e.Time.Format("15:04:05"), e.Level, e.Component, e.Message)
+}
+
+// errorRing keeps the last size warnings and errors.
+type errorRing struct {
+	mu      sync.Mutex
+	size    int
+	entries []RecentError
+	next    int
+}
+
+func (r *errorRing) add(e RecentError) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.entries) < r.size {
+		r.entries = append(r.entries, e)
+		return
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % r.size
+}
+
+// since returns the entries newer than the given time, newest first, at most limit of them.
+func (r *errorRing) since(t time.Time, limit int) []RecentError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var result []RecentError
+	for i := 0; i < len(r.entries) && len(result) < limit; i++ {
+		// Walk backwards from the newest entry.
+		e := r.entries[(r.next-1-i+2*len(r.entries))%len(r.entries)]
+		if e.Time.Before(t) {
+			break
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// dashboardWarnings are the warnings and errors of the last RECENT_ERROR_WINDOW.
+func dashboardWarnings(now time.Time) []string {
+	var warnings []string
+	for _, e := range recentErrors.since(now.Add(-RECENT_ERROR_WINDOW), MAX_DASHBOARD_WARNINGS) {
+		warnings = append(warnings, e.String())
+	}
+	return warnings
+}
+
+// GetRecentErrors returns the warnings and errors kept in the ring buffer, newest first.
+func GetRecentErrors(c *gin.Context) {
+	c.JSON(http.StatusOK, recentErrors.since(time.Time{}, MAX_RECENT_ERRORS))
+}
+
+// recordingHandler passes records on to the output handler and keeps the warnings and errors in the ring buffer.
+type recordingHandler struct {
+	next  slog.Handler
+	ring  *errorRing
+	attrs []slog.Attr
+}
+
+func (h *recordingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *recordingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		e := RecentError{Time: r.Time, Level: r.Level.String()}
+		var fields []string
+		collect := func(a slog.Attr) bool {
+			if a.Key == "component" {
+				e.Component = a.Value.String()
+			} else {
+				fields = append(fields, fmt.Sprintf("%s=%s", a.Key, a.Value))
+			}
+			return true
+		}
+		for _, a := range h.attrs {
+			collect(a)
+		}
+		r.Attrs(collect)
+
+		e.Message = r.Message
+		if len(fields) > 0 {
+			e.Message += " " + strings.Join(fields, " ")
+		}
+		h.ring.add(e)
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *recordingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &recordingHandler{
+		next:  h.next.WithAttrs(attrs),
+		ring:  h.ring,
+		attrs: append(append([]slog.Attr(nil), h.attrs...), attrs...),
+	}
+}
+
+func (h *recordingHandler) WithGroup(name string) slog.Handler {
+	return &recordingHandler{next: h.next.WithGroup(name), ring: h.ring, attrs: h.attrs}
+}
+
+// redactingHandler removes secret values from messages and attributes before they are written or recorded.
+type redactingHandler struct {
+	next slog.Handler
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	redacted := slog.NewRecord(r.Time, r.Level, redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return &redactingHandler{next: h.next.WithAttrs(redacted)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name)}
+}
+
+// redactAttr redacts the attribute as it would be printed, errors and other values included.
+func redactAttr(a slog.Attr) slog.Attr {
+	value := a.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindGroup:
+		group := value.Group()
+		redacted := make([]any, len(group))
+		for i, member := range group {
+			redacted[i] = redactAttr(member)
+		}
+		return slog.Group(a.Key, redacted...)
+	case slog.KindString, slog.KindAny:
+		if s := value.String(); redact(s) != s {
+			return slog.String(a.Key, redact(s))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: value}
+}
+
+// requestLogger replaces gin's access log with structured entries. Server errors are logged as errors so they
+// reach the dashboard warnings.
+func requestLogger(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	status := c.Writer.Status()
+	level := slog.LevelInfo
+	if status >= 500 {
+		level = slog.LevelError
+	}
+	httpLog.Log(c.Request.Context(), level, "request",
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", status,
+		"duration", time.Since(start),
+		"client", clientAddress(c.Request),
+	)
+}
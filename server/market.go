@@ -0,0 +1,166 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// marketSnapshot is a consistent view of everything the diff calculation, the alerting and the handlers read.
+// A published snapshot is never modified: writers go through marketState.update, which hands them a private copy
+// and atomically publishes it once they are done. Readers call market.snapshot() once and use that value for the
+// whole request or cycle, so they never observe a half-applied update and never need a lock.
+type marketSnapshot struct {
+	// Rates are the official fiat rates per USD, keyed by currency, RateTimes when each was last fetched.
+	Rates     map[string]float64
+	RateTimes map[string]time.Time
+	// Reference holds the Coinbase Pro quote of every symbol.
+	Reference map[string]Price
+	// Quotes holds the last quotes each TRY venue returned, keyed by exchange.
+	Quotes map[string][]Price
+	// ReferenceQuotes holds the USD and EUR quotes of the other reference venues, keyed by exchange.
+	ReferenceQuotes map[string][]Price
+	// Liquidity is the order book depth around the mid price, keyed exchange-symbol-currency.
+	Liquidity map[string]Liquidity
+
+	// The fields below are derived from the ones above by calculateDiffs.
+
+	// Diffs are premiums in percent keyed GDAX-exchange-symbol-Ask/Bid, Prices the quotes they were computed from
+	// keyed exchange-symbol-Ask/Bid. Only fresh quotes have an entry.
+	Diffs  map[string]float64
+	Prices map[string]float64
+	// LastQuotes is the latest quote per exchange-symbol, stale or not.
+	LastQuotes map[string]Price
+	// Implied are the stablecoin-implied fiat rates, keyed by fiat.
+	Implied map[string]ImpliedRate
+	// Composite is the index of the fresh reference quotes per symbol in USD, Divergences the warnings of the
+	// symbols whose reference venues disagree.
+	Composite   map[string]Price
+	Divergences map[string]string
+	// IndexConstituents are the reference quotes each composite was built from with their weights.
+	IndexConstituents    map[string][]IndexConstituent
+	MinDiffs, MaxDiffs   map[string]float64
+	MinSymbol, MaxSymbol map[string]string
+}
+
+type marketState struct {
+	writeMux sync.Mutex
+	current  atomic.Value
+}
+
+var market = newMarketState()
+
+func newMarketState() *marketState {
+	state := &marketState{}
+	state.current.Store(&marketSnapshot{
+		Rates:             map[string]float64{},
+		RateTimes:         map[string]time.Time{},
+		Reference:         map[string]Price{},
+		Quotes:            map[string][]Price{},
+		ReferenceQuotes:   map[string][]Price{},
+		Liquidity:         map[string]Liquidity{},
+		Diffs:             map[string]float64{},
+		Prices:            map[string]float64{},
+		LastQuotes:        map[string]Price{},
+		Implied:           map[string]ImpliedRate{},
+		Composite:         map[string]Price{},
+		IndexConstituents: map[string][]IndexConstituent{},
+		Divergences:       map[string]string{},
+		MinDiffs:          map[string]float64{},
+		MaxDiffs:          map[string]float64{},
+		MinSymbol:         map[string]string{},
+		MaxSymbol:         map[string]string{},
+	})
+	return state
+}
+
+// snapshot returns the current view. Callers must treat it as read-only.
+func (m *marketState) snapshot() *marketSnapshot {
+	return m.current.Load().(*marketSnapshot)
+}
+
+// update applies fn to a copy of the current snapshot and publishes the copy. Writers are serialised so no update
+// is lost; readers keep using whichever snapshot they already hold.
+func (m *marketState) update(fn func(next *marketSnapshot)) *marketSnapshot {
+	m.writeMux.Lock()
+	defer m.writeMux.Unlock()
+
+	next := m.snapshot().clone()
+	fn(next)
+	m.current.Store(next)
+	return next
+}
+
+func (s *marketSnapshot) clone() *marketSnapshot {
+	next := &marketSnapshot{
+		Rates:             copyFloats(s.Rates),
+		RateTimes:         make(map[string]time.Time, len(s.RateTimes)),
+		Reference:         make(map[string]Price, len(s.Reference)),
+		Quotes:            make(map[string][]Price, len(s.Quotes)),
+		ReferenceQuotes:   make(map[string][]Price, len(s.ReferenceQuotes)),
+		Liquidity:         make(map[string]Liquidity, len(s.Liquidity)),
+		Diffs:             copyFloats(s.Diffs),
+		Prices:            copyFloats(s.Prices),
+		LastQuotes:        make(map[string]Price, len(s.LastQuotes)),
+		Implied:           make(map[string]ImpliedRate, len(s.Implied)),
+		Composite:         make(map[string]Price, len(s.Composite)),
+		IndexConstituents: make(map[string][]IndexConstituent, len(s.IndexConstituents)),
+		Divergences:       copyStrings(s.Divergences),
+		MinDiffs:          copyFloats(s.MinDiffs),
+		MaxDiffs:          copyFloats(s.MaxDiffs),
+		MinSymbol:         copyStrings(s.MinSymbol),
+		MaxSymbol:         copyStrings(s.MaxSymbol),
+	}
+
+	for currency, fetched := range s.RateTimes {
+		next.RateTimes[currency] = fetched
+	}
+	for key, price := range s.Reference {
+		next.Reference[key] = price
+	}
+	// Quote lists are replaced as a whole and never modified in place, so they can be shared.
+	for key, list := range s.Quotes {
+		next.Quotes[key] = list
+	}
+	for key, list := range s.ReferenceQuotes {
+		next.ReferenceQuotes[key] = list
+	}
+	for key, price := range s.LastQuotes {
+		next.LastQuotes[key] = price
+	}
+	// Implied rates are replaced as a whole, their source lists are shared.
+	for key, rate := range s.Implied {
+		next.Implied[key] = rate
+	}
+	for key, price := range s.Composite {
+		next.Composite[key] = price
+	}
+	// Constituent lists are replaced as a whole, so they can be shared.
+	for key, list := range s.IndexConstituents {
+		next.IndexConstituents[key] = list
+	}
+	for key, l := range s.Liquidity {
+		next.Liquidity[key] = l
+	}
+	return next
+}
+
+func (s *marketSnapshot) rate(currency string) float64 {
+	return s.Rates[currency]
+}
+
+func copyFloats(source map[string]float64) map[string]float64 {
+	result := make(map[string]float64, len(source))
+	for key, value := range source {
+		result[key] = value
+	}
+	return result
+}
+
+func copyStrings(source map[string]string) map[string]string {
+	result := make(map[string]string, len(source))
+	for key, value := range source {
+		result[key] = value
+	}
+	return result
+}
@@ -1,99 +1,242 @@
 package server
 
 import (
-	"bytes"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	PUSHOVER_URI = "https://api.pushover.net/1/messages.json"
-)
-
-var (
-	notificationFlags  map[string]bool
-	notificationTimes  map[string]time.Time
-	PUSHOVER_USER      = ""
-	PUSHOVER_APP_TOKEN = ""
 
 	MIN_NOTI_PERC  = -2.0
 	MAX_NOTI_PERC  = 4.25
 	PAIR_THRESHOLD = 1.0
 	DURATION       = 10.0
+
+	// ESCALATION_AFTER is how long an alert may go unacknowledged with its condition still holding before it is sent
+	// again at PUSHOVER_PRIORITY_HIGH, once per crossing. It never escalates within the cooldown.
+	ESCALATION_AFTER       = 30 * time.Minute
+	PUSHOVER_PRIORITY_HIGH = 1
 )
 
-func sendMessages() {
-	var out string
-	if fiatNotificationEnabled {
-		for _, exchange := range ALL_EXCHANGES {
-			for _, symbol := range ALL_SYMBOLS {
-				exchangeSymbol := fmt.Sprintf("%s-%s", exchange, symbol)
-
-				notificationFlag := notificationFlags[exchangeSymbol]
-				notificationTime := notificationTimes[exchangeSymbol]
-				duration := time.Since(notificationTime)
-
-				commissionFee := 0.0
-				firstExchange := GDAX
-				mux.Lock()
-				spread := spreads[fmt.Sprintf("%s%s", firstExchange, symbol)]
-
-				exchangeSymbolAsk := fmt.Sprintf("%s-%s", exchangeSymbol, "Ask")
-				exchangeSymbolBid := fmt.Sprintf("%s-%s", exchangeSymbol, "Bid")
-				askDiff := diffs[fmt.Sprintf("%s-%s", firstExchange, exchangeSymbolAsk)]
-				bidDiff := diffs[fmt.Sprintf("%s-%s", firstExchange, exchangeSymbolBid)]
-				mux.Unlock()
-
-				if bidDiff > askDiff {
-					continue
+var (
+	notificationFlags map[string]bool
+	notificationTimes map[string]time.Time
+	// notificationEscalated marks the keys whose current crossing was escalated, it is reset when the alert re-arms.
+	notificationEscalated = map[string]bool{}
+	PUSHOVER_USER         = ""
+	PUSHOVER_APP_TOKEN    = ""
+
+	notificationSettings atomic.Value
+)
+
+// NotificationSettings are the alert thresholds changed from the notification page. They are replaced as a whole
+// so the alerting never sees a half-updated configuration.
+type NotificationSettings struct {
+	Minimum       float64 `json:"minimum"`
+	Maximum       float64 `json:"maximum"`
+	PairThreshold float64 `json:"pairThreshold"`
+	Duration      float64 `json:"duration"`
+	FiatEnabled   bool    `json:"fiatEnabled"`
+	PairEnabled   bool    `json:"pairEnabled"`
+}
+
+func init() {
+	notificationSettings.Store(NotificationSettings{
+		Minimum:       MIN_NOTI_PERC,
+		Maximum:       MAX_NOTI_PERC,
+		PairThreshold: PAIR_THRESHOLD,
+		Duration:      DURATION,
+		FiatEnabled:   true,
+		PairEnabled:   true,
+	})
+}
+
+func currentNotificationSettings() NotificationSettings {
+	return notificationSettings.Load().(NotificationSettings)
+}
+
+func setNotificationSettings(settings NotificationSettings) {
+	notificationSettings.Store(settings)
+}
+
+// alertPair is an exchange-symbol pair whose alert condition is evaluated.
+type alertPair struct {
+	Exchange string
+	Symbol   string
+}
+
+// sendMessages evaluates the alert condition of the given pairs. receivedTime is when the oldest quote that
+// triggered the evaluation arrived, it is zero for the periodic sweep.
+func sendMessages(snapshot *marketSnapshot, pairs []alertPair, receivedTime time.Time) {
+	if !receivedTime.IsZero() {
+		defer func() { quoteToAlertLatency.observe(clockSince(receivedTime)) }()
+	}
+	settings := currentNotificationSettings()
+	now, referenceLive := clockNow(), feedConnected(GDAX)
+
+	var fired, escalated, suppressed []Alert
+	if settings.FiatEnabled {
+		for _, pair := range pairs {
+			exchange, symbol := pair.Exchange, pair.Symbol
+			exchangeSymbol := fmt.Sprintf("%s-%s", exchange, symbol)
+
+			notificationFlag := notificationFlags[exchangeSymbol]
+			notificationTime := notificationTimes[exchangeSymbol]
+			duration := clockSince(notificationTime)
+
+			commissionFee := 0.0
+			firstExchange := GDAX
+			// The thresholds widen with the spread of the reference the diffs were computed against.
+			reference, _ := diffReference(snapshot, symbol, now, referenceLive)
+			spread := referenceSpread(reference)
+
+			exchangeSymbolAsk := fmt.Sprintf("%s-%s", exchangeSymbol, "Ask")
+			exchangeSymbolBid := fmt.Sprintf("%s-%s", exchangeSymbol, "Bid")
+			askDiff := snapshot.Diffs[fmt.Sprintf("%s-%s", firstExchange, exchangeSymbolAsk)]
+			bidDiff := snapshot.Diffs[fmt.Sprintf("%s-%s", firstExchange, exchangeSymbolBid)]
+			askPrice := snapshot.Prices[exchangeSymbolAsk]
+			bidPrice := snapshot.Prices[exchangeSymbolBid]
+			currency := snapshot.LastQuotes[exchangeSymbol].Currency
+
+			// Crossed quotes are rejected when they are ingested, a crossed pair of diffs is never alerted on.
+			if bidDiff > askDiff {
+				continue
+			}
+
+			if notificationFlag && askDiff > settings.Minimum-commissionFee - spread && bidDiff < settings.Maximum+commissionFee {
+				notificationFlags[exchangeSymbol] = false
+				delete(notificationEscalated, exchangeSymbol)
+				releaseAlertAck(exchangeSymbol, clockNow())
+			}
+
+			outside := askDiff <= settings.Minimum-commissionFee-spread || bidDiff >= settings.Maximum+commissionFee
+			// An alert that was not acknowledged while its condition kept holding is escalated, once per crossing.
+			escalate := notificationFlag && outside && !notificationEscalated[exchangeSymbol] &&
+				duration >= ESCALATION_AFTER && duration.Minutes() >= settings.Duration
+			if escalate && isAlertSuppressed(exchangeSymbol, clockNow()) {
+				continue
+			}
+
+			if (!notificationFlag && duration.Minutes() >= settings.Duration && outside) || escalate {
+				notificationFlags[exchangeSymbol] = true
+				notificationTimes[exchangeSymbol] = clockNow()
+
+				alert := Alert{
+					Key:            exchangeSymbol,
+					Exchange:       exchange,
+					Symbol:         symbol,
+					AskDiff:        askDiff,
+					BidDiff:        bidDiff,
+					ReferencePrice: reference.Ask,
+					Reference:      reference.Exchange,
+					Currency:       currency,
+					Rate:           snapshot.rate(currency),
+					Spread:         spread,
+					MinThreshold:   settings.Minimum,
+					MaxThreshold:   settings.Maximum,
+					Time:           clockNow(),
+				}
+
+				if askDiff <= settings.Minimum {
+					alert.Side, alert.Diff, alert.Price = "Ask", askDiff, askPrice
+				} else {
+					alert.Side, alert.Diff, alert.Price = "Bid", bidDiff, bidPrice
+				}
+				price := strings.TrimRight(strings.TrimRight(fmt.Sprintf("%f", alert.Price), "0"), ".")
+				alert.Message = fmt.Sprintf("%s %s %%%.2f %s", exchange, symbol, alert.Diff, price)
+				if escalate {
+					notificationEscalated[exchangeSymbol] = true
+					alert.Escalated = true
+					alert.Message += fmt.Sprintf(" (unacknowledged for %.0f min)", duration.Minutes())
 				}
 
-				if notificationFlag && askDiff > MIN_NOTI_PERC-commissionFee - spread && bidDiff < MAX_NOTI_PERC+commissionFee {
-					notificationFlags[exchangeSymbol] = false
+				// An acknowledged or snoozed key is not notified, the crossing is still kept in the history.
+				if isAlertSuppressed(exchangeSymbol, clockNow()) {
+					alert.Status = ALERT_STATUS_SUPPRESSED
+					suppressed = append(suppressed, alert)
+					continue
 				}
 
-				if !notificationFlag && duration.Minutes() >= DURATION &&
-					(askDiff <= MIN_NOTI_PERC-commissionFee - spread || bidDiff >= MAX_NOTI_PERC+commissionFee) {
-					notificationFlags[exchangeSymbol] = true
-					notificationTimes[exchangeSymbol] = time.Now()
-
-					if askDiff <= MIN_NOTI_PERC {
-						askPrice := strings.TrimRight(strings.TrimRight(fmt.Sprintf("%f", prices[exchangeSymbolAsk]), "0"), ".")
-						out += fmt.Sprintf("%s %s %%%.2f %s\n", exchange, symbol, askDiff, askPrice)
-					} else {
-						bidPrice := strings.TrimRight(strings.TrimRight(fmt.Sprintf("%f", prices[exchangeSymbolBid]), "0"), ".")
-						out += fmt.Sprintf("%s %s %%%.2f %s\n", exchange, symbol, bidDiff, bidPrice)
-					}
+				if escalate {
+					escalated = append(escalated, alert)
+				} else {
+					fired = append(fired, alert)
 				}
 			}
 		}
 	}
 
-	sendPushoverMessage(out)
+	if len(suppressed) > 0 {
+		alertsSent.add(float64(len(suppressed)), PUSHOVER, ALERT_STATUS_SUPPRESSED)
+		for _, alert := range suppressed {
+			alertLog.Info("alert suppressed", "exchange", alert.Exchange, "symbol", alert.Symbol, "side", alert.Side,
+				"diff", alert.Diff)
+		}
+		recordAlerts(suppressed)
+	}
+	notifyAlerts(fired, 0)
+	notifyAlerts(escalated, PUSHOVER_PRIORITY_HIGH)
 }
 
-func sendPushoverMessage(message string) {
-	if message == "" {
+// notifyAlerts sends alerts as one Pushover message of the given priority and records them with the outcome.
+func notifyAlerts(fired []Alert, priority int) {
+	if len(fired) == 0 {
 		return
 	}
 
+	var out string
+	for _, alert := range fired {
+		out += alert.Message + "\n"
+	}
+	status, errMessage := ALERT_STATUS_SENT, ""
+	if err := sendPushoverMessage(out, priority); err != nil {
+		status, errMessage = ALERT_STATUS_FAILED, err.Error()
+	}
+	alertsSent.add(float64(len(fired)), PUSHOVER, status)
+	for i := range fired {
+		fired[i].Status = status
+		fired[i].Error = errMessage
+		alertLog.Info("alert fired", "exchange", fired[i].Exchange, "symbol", fired[i].Symbol, "side", fired[i].Side,
+			"diff", fired[i].Diff, "status", status, "escalated", fired[i].Escalated)
+	}
+	recordAlerts(fired)
+}
+
+func sendPushoverMessage(message string, priority int) error {
+	if message == "" {
+		return nil
+	}
+	if PUSHOVER_USER == "" || PUSHOVER_APP_TOKEN == "" {
+		return fmt.Errorf("failed to send the message to pushover : no credentials")
+	}
+
 	// POST
 	form := url.Values{
 		"user":    {PUSHOVER_USER},
 		"token":   {PUSHOVER_APP_TOKEN},
 		"message": {message},
 	}
+	if priority != 0 {
+		form.Set("priority", strconv.Itoa(priority))
+	}
 
-	body := bytes.NewBufferString(form.Encode())
-	_, err := http.Post(PUSHOVER_URI, "application/x-www-form-urlencoded", body)
+	req, err := http.NewRequest(http.MethodPost, PUSHOVER_URI, strings.NewReader(form.Encode()))
 	if err != nil {
-		fmt.Println("Failed to send the message to pushover : ", err)
-		log.Println("Failed to send the message to pushover : ", err)
+		return fmt.Errorf("could not create pushover request : %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if _, err := getClient(PUSHOVER).do(req); err != nil {
+		alertLog.Error("cannot send the message", "channel", PUSHOVER, "error", err)
+		return fmt.Errorf("failed to send the message to pushover : %s", err)
 	}
 
-	log.Println("Sent message ", message)
+	alertLog.Info("message sent", "channel", PUSHOVER, "message", message)
+	return nil
 }
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// alertTimingTest runs the alert engine of the Paribu BTC pair on a virtual clock starting at start, with a
+// cooldown of 10 minutes. evaluate advances the clock to at, evaluates a bid diff and checks whether that sent an
+// alert, the messages it returns are the ones sent by that evaluation.
+func alertTimingTest(t *testing.T, start time.Time) func(at time.Duration, bidDiff float64, expectAlert bool) []url.Values {
+	fake := newFakeExchange(t)
+	useFakeExchange(t, fake)
+
+	virtual := newVirtualClock(start)
+	previous := setClock(virtual)
+	t.Cleanup(func() { setClock(previous) })
+
+	settings := currentNotificationSettings()
+	t.Cleanup(func() { setNotificationSettings(settings) })
+	testSettings := settings
+	testSettings.Minimum, testSettings.Maximum, testSettings.Duration = -2, 4.25, 10
+	testSettings.FiatEnabled = true
+	setNotificationSettings(testSettings)
+
+	pairs := []alertPair{{Exchange: PARIBU, Symbol: "BTC"}}
+	sent := 0
+	return func(at time.Duration, bidDiff float64, expectAlert bool) []url.Values {
+		t.Helper()
+		virtual.advanceTo(start.Add(at))
+		snapshot := &marketSnapshot{
+			Diffs: map[string]float64{
+				"GDAX-Paribu-BTC-Ask": bidDiff + 0.1,
+				"GDAX-Paribu-BTC-Bid": bidDiff,
+			},
+			Prices: map[string]float64{"Paribu-BTC-Ask": 1576500, "Paribu-BTC-Bid": 1575000},
+		}
+		sendMessages(snapshot, pairs, time.Time{})
+
+		messages := fake.sentMessages()
+		if fired := len(messages) > sent; fired != expectAlert {
+			t.Fatalf("at %s with a bid diff of %v: expected an alert %v, got %v", at, bidDiff, expectAlert, fired)
+		}
+		for _, message := range messages[sent:] {
+			if !strings.HasPrefix(message.Get("message"), "Paribu BTC %") {
+				t.Errorf("unexpected alert %q", message.Get("message"))
+			}
+		}
+		fired := messages[sent:]
+		sent = len(messages)
+		return fired
+	}
+}
+
+// TestAlertTiming runs the alert engine on a virtual clock. An alert needs the condition to clear before it fires
+// again (re-arm), never fires twice within DURATION minutes (cooldown) and stays silent while it is snoozed. A
+// crossing silenced by the snooze still starts a cooldown.
+func TestAlertTiming(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	evaluate := alertTimingTest(t, start)
+
+	evaluate(0, 5, true)
+	evaluate(30*time.Second, 5, false) // still out of the thresholds, not re-armed
+	evaluate(time.Minute, 1, false)    // cleared, re-armed
+	evaluate(2*time.Minute, 5, false)  // re-armed but within the cooldown
+	evaluate(10*time.Minute, 5, true)  // the cooldown is over
+
+	snoozeAlert("Paribu-BTC", 30*time.Minute)
+	evaluate(11*time.Minute, 1, false)
+	evaluate(21*time.Minute, 5, false) // snoozed
+	evaluate(22*time.Minute, 1, false)
+	evaluate(35*time.Minute, 5, false) // snoozed until 40 minutes, the cooldown starts again
+	evaluate(40*time.Minute, 1, false)
+	evaluate(44*time.Minute, 5, false) // the snooze is over, the cooldown is not
+	evaluate(45*time.Minute, 5, true)
+
+	recorded := filterAlerts(alertFilter{Status: ALERT_STATUS_SENT, Limit: 10})
+	if len(recorded) != 3 {
+		t.Fatalf("expected 3 sent alerts, got %d : %+v", len(recorded), recorded)
+	}
+	for _, alert := range recorded {
+		if elapsed := alert.Time.Sub(start); elapsed != 0 && elapsed != 10*time.Minute && elapsed != 45*time.Minute {
+			t.Errorf("expected the alerts at the virtual times, got one at %s", elapsed)
+		}
+	}
+
+	// The snoozed crossings are kept in the history.
+	suppressed := filterAlerts(alertFilter{Status: ALERT_STATUS_SUPPRESSED, Limit: 10})
+	if len(suppressed) != 2 {
+		t.Fatalf("expected 2 suppressed alerts, got %d : %+v", len(suppressed), suppressed)
+	}
+	for _, alert := range suppressed {
+		if elapsed := alert.Time.Sub(start); elapsed != 21*time.Minute && elapsed != 35*time.Minute {
+			t.Errorf("expected the suppressed alerts at the snoozed crossings, got one at %s", elapsed)
+		}
+	}
+}
+
+// TestAlertEscalation checks that an alert whose condition keeps holding without an acknowledgement is sent again at
+// a high priority after ESCALATION_AFTER, once per crossing, and that an acknowledged alert is not escalated.
+func TestAlertEscalation(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	evaluate := alertTimingTest(t, start)
+
+	if messages := evaluate(0, 5, true); messages[0].Get("priority") != "" {
+		t.Errorf("expected the first alert at the normal priority, got %q", messages[0].Get("priority"))
+	}
+	evaluate(15*time.Minute, 5, false)
+	evaluate(ESCALATION_AFTER-time.Second, 5, false) // held, not escalated yet
+	escalated := evaluate(ESCALATION_AFTER, 5, true)
+	if priority := escalated[0].Get("priority"); priority != "1" {
+		t.Errorf("expected the escalation at priority 1, got %q", priority)
+	}
+	if !strings.Contains(escalated[0].Get("message"), "unacknowledged for 30 min") {
+		t.Errorf("unexpected escalation %q", escalated[0].Get("message"))
+	}
+	evaluate(2*ESCALATION_AFTER+time.Minute, 5, false) // escalated once per crossing
+
+	// A new crossing fires at the normal priority and is acknowledged, so it is never escalated.
+	evaluate(70*time.Minute, 1, false)
+	if messages := evaluate(71*time.Minute, 5, true); messages[0].Get("priority") != "" {
+		t.Errorf("expected the new crossing at the normal priority, got %q", messages[0].Get("priority"))
+	}
+	acknowledgeAlert("Paribu-BTC")
+	evaluate(71*time.Minute+ESCALATION_AFTER, 5, false)
+	evaluate(3*time.Hour, 5, false)
+
+	recorded := filterAlerts(alertFilter{Status: ALERT_STATUS_SENT, Limit: 10})
+	if len(recorded) != 3 {
+		t.Fatalf("expected 3 sent alerts, got %d : %+v", len(recorded), recorded)
+	}
+	for _, alert := range recorded {
+		if escalated := alert.Time.Sub(start) == ESCALATION_AFTER; alert.Escalated != escalated {
+			t.Errorf("alert at %s : expected escalated %v, got %v", alert.Time.Sub(start), escalated, alert.Escalated)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	// DURATION_BUCKETS are the upper bounds, in seconds, of the duration histograms.
+	DURATION_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+	fetchDuration    = newHistogramVec([]string{"exchange"}, DURATION_BUCKETS)
+	fetchErrors      = newCounterVec([]string{"exchange"})
+	alertsSent       = newCounterVec([]string{"channel", "status"})
+	diffLoopDuration = newHistogramVec(nil, DURATION_BUCKETS)
+)
+
+// counterVec is a Prometheus counter with a fixed set of labels, one series per combination of label values.
+type counterVec struct {
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func newCounterVec(labels []string) *counterVec {
+	return &counterVec{labels: labels, values: map[string]float64{}, keys: map[string][]string{}}
+}
+
+func (c *counterVec) add(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key] += value
+	c.keys[key] = labelValues
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w *metricsWriter, name, help string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w.header(name, help, "counter")
+	for _, key := range sortedKeys(c.keys) {
+		w.sample(name, c.labels, c.keys[key], c.values[key])
+	}
+}
+
+// histogramVec is a Prometheus histogram with a fixed set of labels.
+type histogramVec struct {
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+	keys    map[string][]string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(labels []string, buckets []float64) *histogramVec {
+	return &histogramVec{labels: labels, buckets: buckets, series: map[string]*histogram{}, keys: map[string][]string{}}
+}
+
+func (h *histogramVec) observe(d time.Duration, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	seconds := d.Seconds()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+		h.keys[key] = labelValues
+	}
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			series.counts[i]++
+		}
+	}
+	series.sum += seconds
+	series.count++
+}
+
+func (h *histogramVec) write(w *metricsWriter, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w.header(name, help, "histogram")
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range sortedKeys(h.keys) {
+		series, labelValues := h.series[key], h.keys[key]
+		for i, bound := range h.buckets {
+			values := append(append([]string(nil), labelValues...), fmt.Sprint(bound))
+			w.sample(name+"_bucket", bucketLabels, values, float64(series.counts[i]))
+		}
+		w.sample(name+"_bucket", bucketLabels, append(append([]string(nil), labelValues...), "+Inf"), float64(series.count))
+		w.sample(name+"_sum", h.labels, labelValues, series.sum)
+		w.sample(name+"_count", h.labels, labelValues, float64(series.count))
+	}
+}
+
+func sortedKeys(keys map[string][]string) []string {
+	var sorted []string
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// metricsWriter renders the Prometheus text exposition format.
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *metricsWriter) header(name, help, kind string) {
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (w *metricsWriter) sample(name string, labels, values []string, value float64) {
+	w.buf.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, len(labels))
+		for i, label := range labels {
+			pairs[i] = fmt.Sprintf("%s=%q", label, values[i])
+		}
+		w.buf.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	fmt.Fprintf(&w.buf, " %s\n", formatMetricValue(value))
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return fmt.Sprint(value)
+}
+
+// gauge writes a gauge whose samples are computed at scrape time, sample is called once per series.
+func (w *metricsWriter) gauge(name, help string, labels []string, collect func(sample func(value float64, labelValues ...string))) {
+	w.header(name, help, "gauge")
+	collect(func(value float64, labelValues ...string) {
+		w.sample(name, labels, labelValues, value)
+	})
+}
+
+// GetMetrics exports the feeds, the diffs and the alerting in the Prometheus text format. Counters and histograms
+// are kept as events happen, gauges are read from the current snapshot at scrape time.
+func GetMetrics(c *gin.Context) {
+	snapshot := market.snapshot()
+	now := clockNow()
+	w := &metricsWriter{}
+
+	fetchDuration.write(w, "arbitrage_fetch_duration_seconds", "Duration of the REST price polls per exchange.")
+	fetchErrors.write(w, "arbitrage_fetch_errors_total", "Failed REST price polls per exchange.")
+
+	w.gauge("arbitrage_quote_age_seconds", "Age of the latest quote per exchange and symbol.", []string{"exchange", "currency", "symbol"},
+		func(sample func(float64, ...string)) {
+			var quotes []Price
+			for _, p := range snapshot.Reference {
+				quotes = append(quotes, p)
+			}
+			for _, p := range snapshot.LastQuotes {
+				quotes = append(quotes, p)
+			}
+			for _, list := range snapshot.ReferenceQuotes {
+				for _, p := range list {
+					if !isCorridor(p.Currency) {
+						quotes = append(quotes, p)
+					}
+				}
+			}
+			sort.Slice(quotes, func(i, j int) bool { return quoteKey(quotes[i]) < quoteKey(quotes[j]) })
+
+			for _, p := range quotes {
+				if age := p.Age(now); age != NEVER_AGE {
+					sample(age.Seconds(), p.Exchange, p.Currency, p.ID)
+				}
+			}
+		})
+
+	feeds := feedStatuses()
+	w.gauge("arbitrage_websocket_connected", "Whether the websocket feed of an exchange is connected.", []string{"exchange"},
+		func(sample func(float64, ...string)) {
+			for _, feed := range feeds {
+				connected := 0.0
+				if feed.State == FEED_CONNECTED {
+					connected = 1
+				}
+				sample(connected, feed.Name)
+			}
+		})
+	w.header("arbitrage_websocket_reconnects_total", "Reconnects of the websocket feed of an exchange.", "counter")
+	for _, feed := range feeds {
+		w.sample("arbitrage_websocket_reconnects_total", []string{"exchange"}, []string{feed.Name}, float64(feed.Reconnects))
+	}
+
+	w.gauge("arbitrage_diff_percent", "Current premium of a venue's ask or bid over the reference, in percent.",
+		[]string{"exchange", "symbol", "side"}, func(sample func(float64, ...string)) {
+			var keys []string
+			for key := range snapshot.Diffs {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			for _, key := range keys {
+				sample(snapshot.Diffs[key], keyPart(key, 1), keyPart(key, 2), keyPart(key, 3))
+			}
+		})
+
+	w.gauge("arbitrage_fx_rate", "USD rate of a fiat, the official one.", []string{"currency"},
+		func(sample func(float64, ...string)) {
+			var currencies []string
+			for currency := range snapshot.Rates {
+				currencies = append(currencies, currency)
+			}
+			sort.Strings(currencies)
+
+			for _, currency := range currencies {
+				sample(snapshot.Rates[currency], currency)
+			}
+		})
+	w.gauge("arbitrage_implied_fx_rate", "Stablecoin-implied USD rate of a fiat.", []string{"currency"},
+		func(sample func(float64, ...string)) {
+			for _, fiat := range corridors {
+				if implied, ok := snapshot.Implied[fiat]; ok {
+					sample(implied.Rate, fiat)
+				}
+			}
+		})
+
+	alertsSent.write(w, "arbitrage_alerts_total", "Alerts per notification channel and delivery status.")
+	diffLoopDuration.write(w, "arbitrage_calculate_diffs_duration_seconds", "Duration of one pass of the diff loop.")
+
+	w.header("arbitrage_dropped_quote_events_total", "Quote events dropped because the diff loop fell behind.", "counter")
+	w.sample("arbitrage_dropped_quote_events_total", nil, nil, float64(atomic.LoadInt64(&droppedQuoteEvents)))
+
+	w.header("arbitrage_rejected_quotes_total", "Quotes rejected by validation per exchange and reason.", "counter")
+	for _, status := range qualityStatuses() {
+		var reasons []string
+		for reason := range status.Incidents {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+
+		for _, reason := range reasons {
+			w.sample("arbitrage_rejected_quotes_total", []string{"exchange", "reason"}, []string{status.Exchange, reason},
+				float64(status.Incidents[reason]))
+		}
+	}
+
+	c.Data(http.StatusOK, METRICS_CONTENT_TYPE, w.buf.Bytes())
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_QUOTE_AGE = 30 * time.Second
+	NEVER_AGE             = time.Duration(math.MaxInt64)
+)
+
+var (
+	// maxQuoteAges is how old a quote of each source may get before it is considered stale. Every value can be
+	// overridden with MAX_QUOTE_AGE_<EXCHANGE>, e.g. MAX_QUOTE_AGE_PARIBU=20s, and the fallback with MAX_QUOTE_AGE.
+	//
+	// The references, Coinbase Pro and Kraken, keep the default: every alert is priced against them, so an old
+	// reference quote is worse than none. Their tickers only move on trades, a deployment watching quiet books can
+	// opt into a longer limit with MAX_QUOTE_AGE_GDAX and MAX_QUOTE_AGE_KRAKEN.
+	maxQuoteAges = map[string]time.Duration{
+		KOINIM: 1 * time.Minute,
+	}
+	defaultMaxQuoteAge = DEFAULT_MAX_QUOTE_AGE
+)
+
+func init() {
+	if value := os.Getenv("MAX_QUOTE_AGE"); value != "" {
+		if age, err := time.ParseDuration(value); err != nil {
+			configLog.Warn("invalid setting", "name", "MAX_QUOTE_AGE", "value", value, "error", err)
+		} else {
+			defaultMaxQuoteAge = age
+		}
+	}
+
+	for _, exchange := range []string{GDAX, PARIBU, BTCTURK, KOINEKS, KOINIM, VEBITCOIN, BINANCE, BITTREX, BITFINEX, KRAKEN, BITSTAMP, BITOASIS, BINANCE_USDT} {
+		name := "MAX_QUOTE_AGE_" + strings.ToUpper(exchange)
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+
+		age, err := time.ParseDuration(value)
+		if err != nil {
+			configLog.Warn("invalid setting", "name", name, "value", value, "error", err)
+			continue
+		}
+		maxQuoteAges[exchange] = age
+	}
+}
+
+func maxQuoteAge(exchange string) time.Duration {
+	if age, ok := maxQuoteAges[exchange]; ok {
+		return age
+	}
+	return defaultMaxQuoteAge
+}
+
+// Age is how old the quote is. The exchange timestamp is preferred when the venue reports one, since a venue can
+// keep serving a frozen book that we receive fresh on every poll.
+func (p Price) Age(now time.Time) time.Duration {
+	quoteTime := p.ReceivedTime
+	if !p.ExchangeTime.IsZero() && p.ExchangeTime.Before(quoteTime) {
+		quoteTime = p.ExchangeTime
+	}
+	if quoteTime.IsZero() {
+		return NEVER_AGE
+	}
+	return now.Sub(quoteTime)
+}
+
+func (p Price) Stale(now time.Time) bool {
+	return p.Age(now) > maxQuoteAge(p.Exchange)
+}
+
+func formatAge(age time.Duration) string {
+	if age == NEVER_AGE {
+		return "never updated"
+	}
+	if age < time.Minute {
+		return fmt.Sprintf("%ds", int(age.Seconds()))
+	}
+	if age < time.Hour {
+		return fmt.Sprintf("%dm%02ds", int(age.Minutes()), int(age.Seconds())%60)
+	}
+	return fmt.Sprintf("%dh%02dm", int(age.Hours()), int(age.Minutes())%60)
+}
@@ -0,0 +1,451 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/gin-gonic/gin"
+	ws "github.com/gorilla/websocket"
+)
+
+const (
+	KRAKEN_URI      = "https://api.kraken.com/0/public/Ticker?pair=%s"
+	KRAKEN_WS_URI   = "wss://ws.kraken.com"
+	BITSTAMP_URI    = "https://www.bitstamp.net/api/v2/ticker/%s/"
+	BITSTAMP_WS_URI = "wss://ws.bitstamp.net"
+
+	KRAKEN_SILENCE_TIMEOUT   = 30 * time.Second
+	BITSTAMP_SILENCE_TIMEOUT = 1 * time.Minute
+
+	COMPOSITE = "Composite"
+
+	REFERENCE_COINBASE  = "coinbase"
+	REFERENCE_COMPOSITE = "composite"
+
+	DEFAULT_REFERENCE_DIVERGENCE = 1.0
+)
+
+var (
+	referenceFiats     = []string{"USD", "EUR"}
+	krakenCurrencies   = []string{"BTC", "ETH", "LTC", "BCH", "ETC", "XLM", "EOS", "LINK", "DASH", "ZEC", "MKR", "ADA", "USDT", "DOGE"}
+	bitstampCurrencies = []string{"BTC", "ETH", "LTC", "BCH", "XLM", "LINK"}
+	// krakenAssets are the symbols Kraken names differently.
+	krakenAssets = map[string]string{"BTC": "XBT", "DOGE": "XDG"}
+
+	// referenceSource selects what the premiums are computed against, Coinbase Pro alone or the composite index of
+	// every live reference venue, so a single bad tick cannot skew every diff. It is set with REFERENCE_SOURCE.
+	referenceSource = REFERENCE_COMPOSITE
+	// referenceDivergence is how far, in percent, a reference venue may be from the composite before a warning is
+	// shown. It is set with REFERENCE_DIVERGENCE.
+	referenceDivergence = DEFAULT_REFERENCE_DIVERGENCE
+
+	krakenBook   = newStreamBook(KRAKEN, publishReferenceQuotes)
+	bitstampBook = newStreamBook(BITSTAMP, publishReferenceQuotes)
+)
+
+func init() {
+	switch source := os.Getenv("REFERENCE_SOURCE"); source {
+	case "":
+	case REFERENCE_COINBASE, REFERENCE_COMPOSITE:
+		referenceSource = source
+	default:
+		configLog.Warn("invalid setting", "name", "REFERENCE_SOURCE", "value", source, "using", referenceSource)
+	}
+
+	if value := os.Getenv("REFERENCE_DIVERGENCE"); value != "" {
+		percent, err := strconv.ParseFloat(value, 64)
+		if err != nil || percent <= 0 {
+			configLog.Warn("invalid setting", "name", "REFERENCE_DIVERGENCE", "value", value)
+		} else {
+			referenceDivergence = percent
+		}
+	}
+}
+
+// publishReferenceQuotes replaces the quotes of a reference venue. The composite of the given symbols, and the
+// premiums when they are computed against it, are recalculated.
+func publishReferenceQuotes(exchange string, list []Price, symbols []string, receivedTime time.Time) {
+	if !adapterEnabled(exchange) {
+		return
+	}
+	market.update(func(next *marketSnapshot) {
+		next.ReferenceQuotes[exchange] = list
+	})
+	emitQuoteEvent(quoteEvent{Symbols: symbols, ReceivedTime: receivedTime})
+}
+
+// diffReference is the USD price the premiums of a symbol are computed against, Coinbase Pro or the composite
+// index as referenceSource selects, and whether it is too old to compute premiums from. Alerts and the dashboard
+// show the same price the diffs came from.
+func diffReference(snapshot *marketSnapshot, symbol string, now time.Time, coinbaseLive bool) (Price, bool) {
+	if referenceSource == REFERENCE_COMPOSITE {
+		composite, ok := snapshot.Composite[symbol]
+		return composite, !ok || composite.Stale(now)
+	}
+	p, ok := snapshot.Reference[symbol]
+	return p, !ok || !coinbaseLive || p.Stale(now)
+}
+
+// referenceSpread is the spread of a reference price in percent of its bid.
+func referenceSpread(p Price) float64 {
+	if p.Bid == 0 {
+		return 0
+	}
+	return (p.Ask - p.Bid) * 100 / p.Bid
+}
+
+// referenceQuotes collects the fresh quotes of a symbol on every reference venue as index constituents in USD.
+// Quotes in a fiat whose rate is unknown are left out, USDT quotes are converted at the USDT reference price.
+func referenceQuotes(snapshot *marketSnapshot, symbol string, now time.Time, coinbaseLive bool) []IndexConstituent {
+	var quotes []IndexConstituent
+	if p, ok := snapshot.Reference[symbol]; ok && coinbaseLive && !p.Stale(now) && p.Ask > 0 && p.Bid > 0 {
+		quotes = append(quotes, newIndexConstituent(GDAX, p.Ask, p.Bid, p.Volume))
+	}
+
+	usdt := 1.0
+	if p, ok := snapshot.Reference["USDT"]; ok && coinbaseLive && !p.Stale(now) && p.Ask > 0 && p.Bid > 0 {
+		usdt = (p.Ask + p.Bid) / 2
+	}
+
+	var exchanges []string
+	for exchange := range snapshot.ReferenceQuotes {
+		exchanges = append(exchanges, exchange)
+	}
+	sort.Strings(exchanges)
+
+	for _, exchange := range exchanges {
+		for _, p := range snapshot.ReferenceQuotes[exchange] {
+			if p.ID != symbol || p.Stale(now) || p.Ask <= 0 || p.Bid <= 0 {
+				continue
+			}
+
+			rate := 1.0
+			switch p.Currency {
+			case "USD":
+			case "USDT":
+				rate = 1 / usdt
+			default:
+				rate = snapshot.rate(p.Currency)
+			}
+			if rate == 0 {
+				continue
+			}
+			quotes = append(quotes, newIndexConstituent(p.Exchange+" "+p.Currency, p.Ask/rate, p.Bid/rate, p.Volume))
+		}
+	}
+	return quotes
+}
+
+// referenceDivergenceWarning names the venues whose mid price is further than referenceDivergence from the
+// composite mid price, or returns "" when they all agree. Constituents rejected as outliers are included.
+func referenceDivergenceWarning(symbol string, quotes []IndexConstituent, composite Price) string {
+	if len(quotes) < 2 {
+		return ""
+	}
+
+	compositeMid := (composite.Ask + composite.Bid) / 2
+	var diverging []string
+	for _, q := range quotes {
+		divergence := (q.Mid - compositeMid) * 100 / compositeMid
+		if divergence > referenceDivergence || divergence < -referenceDivergence {
+			diverging = append(diverging, fmt.Sprintf("%s %%%.2f", q.Source, divergence))
+		}
+	}
+	if len(diverging) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s reference venues diverge from the composite : %s", symbol, strings.Join(diverging, ", "))
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// referenceWarnings returns the divergence warnings sorted by symbol.
+func referenceWarnings(snapshot *marketSnapshot) []string {
+	var warnings []string
+	for _, warning := range snapshot.Divergences {
+		warnings = append(warnings, warning)
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
+func GetReference(c *gin.Context) {
+	snapshot := market.snapshot()
+	c.JSON(http.StatusOK, gin.H{
+		"source":     referenceSource,
+		"coinbase":   snapshot.Reference,
+		"venues":     snapshot.ReferenceQuotes,
+		"composite":  snapshot.Composite,
+		"divergence": referenceWarnings(snapshot),
+	})
+}
+
+func krakenPair(symbol, fiat string) string {
+	if asset, ok := krakenAssets[symbol]; ok {
+		symbol = asset
+	}
+	return symbol + fiat
+}
+
+// krakenSymbol maps a result key of the Kraken ticker, which may carry the legacy X and Z prefixes as in
+// XXBTZUSD, back to the symbol and fiat.
+func krakenSymbol(key string) (string, string, bool) {
+	for _, symbol := range krakenCurrencies {
+		for _, fiat := range referenceFiats {
+			pair := krakenPair(symbol, fiat)
+			asset := strings.TrimSuffix(pair, fiat)
+			if key == pair || key == asset+"Z"+fiat || key == "X"+asset+"Z"+fiat {
+				return symbol, fiat, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+func getKrakenPrices() ([]Price, error) {
+	var pairs []string
+	for _, symbol := range krakenCurrencies {
+		for _, fiat := range referenceFiats {
+			if symbol != "USDT" || fiat == "USD" {
+				pairs = append(pairs, krakenPair(symbol, fiat))
+			}
+		}
+	}
+
+	responseData, err := getClient(KRAKEN).get(fmt.Sprintf(KRAKEN_URI, strings.Join(pairs, ",")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Kraken response : %s", err)
+	}
+	receivedTime := clockNow()
+
+	if message, _, _, _ := jsonparser.Get(responseData, "error", "[0]"); len(message) > 0 {
+		return nil, fmt.Errorf("Kraken ticker request failed : %s", message)
+	}
+
+	var prices []Price
+	err = jsonparser.ObjectEach(responseData, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		symbol, fiat, ok := krakenSymbol(string(key))
+		if !ok {
+			return nil
+		}
+
+		pAsk, err := getJSONFloat(value, "a", "[0]")
+		if err != nil {
+			return fmt.Errorf("failed to read the %s ask price from the Kraken response data: %s", key, err)
+		}
+		pBid, err := getJSONFloat(value, "b", "[0]")
+		if err != nil {
+			return fmt.Errorf("failed to read the %s bid price from the Kraken response data: %s", key, err)
+		}
+		// The second volume is the one of the last 24 hours.
+		volume, _ := getJSONFloat(value, "v", "[1]")
+
+		prices = append(prices, Price{Exchange: KRAKEN, Currency: fiat, ID: symbol, Ask: pAsk, Bid: pBid, Volume: volume,
+			ReceivedTime: receivedTime})
+		return nil
+	}, "result")
+	if err != nil {
+		return nil, err
+	}
+
+	return prices, nil
+}
+
+func getBitstampPrices() ([]Price, error) {
+	var prices []Price
+
+	for _, symbol := range bitstampCurrencies {
+		for _, fiat := range referenceFiats {
+			pair := strings.ToLower(symbol + fiat)
+			responseData, err := getClient(BITSTAMP).get(fmt.Sprintf(BITSTAMP_URI, pair))
+			if err != nil {
+				return nil, fmt.Errorf("failed to get Bitstamp response : %s", err)
+			}
+			receivedTime := clockNow()
+
+			pAsk, err := getJSONFloat(responseData, "ask")
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the %s ask price from the Bitstamp response data: %s", pair, err)
+			}
+			pBid, err := getJSONFloat(responseData, "bid")
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the %s bid price from the Bitstamp response data: %s", pair, err)
+			}
+
+			volume, _ := getJSONFloat(responseData, "volume")
+
+			var exchangeTime time.Time
+			if seconds, err := getJSONFloat(responseData, "timestamp"); err == nil {
+				exchangeTime = time.Unix(int64(seconds), 0)
+			}
+
+			prices = append(prices, Price{Exchange: BITSTAMP, Currency: fiat, ID: symbol, Ask: pAsk, Bid: pBid,
+				Volume: volume, ExchangeTime: exchangeTime, ReceivedTime: receivedTime})
+		}
+	}
+
+	return prices, nil
+}
+
+// startKrakenWS streams Kraken's ticker channel, which carries the best bid and ask and is pushed whenever they
+// change. Kraken sends heartbeats while pairs are quiet.
+func startKrakenWS(ctx context.Context) {
+	feed := registerFeed(&wsFeed{
+		name:           KRAKEN,
+		uri:            KRAKEN_WS_URI,
+		silenceTimeout: KRAKEN_SILENCE_TIMEOUT,
+		subscribe:      subscribeKraken,
+		handle:         handleKrakenMessage,
+	})
+	feed.run(ctx)
+}
+
+func subscribeKraken(conn *ws.Conn) error {
+	seedStreamBook(krakenBook, getKrakenPrices)
+
+	var pairs []string
+	for _, symbol := range krakenCurrencies {
+		for _, fiat := range referenceFiats {
+			if symbol != "USDT" || fiat == "USD" {
+				pairs = append(pairs, strings.TrimSuffix(krakenPair(symbol, fiat), fiat)+"/"+fiat)
+			}
+		}
+	}
+
+	subscribe := map[string]interface{}{
+		"event":        "subscribe",
+		"pair":         pairs,
+		"subscription": map[string]string{"name": "ticker"},
+	}
+	return conn.WriteJSON(subscribe)
+}
+
+// handleKrakenMessage reads the [channelID, ticker, "ticker", pair] frames of Kraken. Events such as heartbeats
+// and subscription results are objects and only errors among them are reported.
+func handleKrakenMessage(data []byte) error {
+	receivedTime := clockNow()
+
+	if event, err := jsonparser.GetString(data, "event"); err == nil {
+		if status, _ := jsonparser.GetString(data, "status"); event == "subscriptionStatus" && status == "error" {
+			message, _ := jsonparser.GetString(data, "errorMessage")
+			return fmt.Errorf("kraken subscription failed : %s", message)
+		}
+		return nil
+	}
+
+	pairName, err := jsonparser.GetString(data, "[3]")
+	if err != nil {
+		return fmt.Errorf("failed to read the pair from the Kraken stream data : %s", err)
+	}
+	symbol, fiat, ok := krakenSymbol(strings.Replace(pairName, "/", "", 1))
+	if !ok {
+		return nil
+	}
+
+	pAsk, err := getJSONFloat(data, "[1]", "a", "[0]")
+	if err != nil {
+		return fmt.Errorf("failed to read the %s ask price from the Kraken stream data: %s", pairName, err)
+	}
+	pBid, err := getJSONFloat(data, "[1]", "b", "[0]")
+	if err != nil {
+		return fmt.Errorf("failed to read the %s bid price from the Kraken stream data: %s", pairName, err)
+	}
+
+	volume, _ := getJSONFloat(data, "[1]", "v", "[1]")
+
+	krakenBook.set(Price{Exchange: KRAKEN, Currency: fiat, ID: symbol, Ask: pAsk, Bid: pBid, Volume: volume})
+	krakenBook.publish(receivedTime, []string{symbol})
+	return nil
+}
+
+// startBitstampWS streams the order_book channel of every Bitstamp pair and keeps the top of each book.
+func startBitstampWS(ctx context.Context) {
+	feed := registerFeed(&wsFeed{
+		name:           BITSTAMP,
+		uri:            BITSTAMP_WS_URI,
+		silenceTimeout: BITSTAMP_SILENCE_TIMEOUT,
+		subscribe:      subscribeBitstamp,
+		handle:         handleBitstampMessage,
+	})
+	feed.run(ctx)
+}
+
+func subscribeBitstamp(conn *ws.Conn) error {
+	seedStreamBook(bitstampBook, getBitstampPrices)
+
+	for _, symbol := range bitstampCurrencies {
+		for _, fiat := range referenceFiats {
+			subscribe := map[string]interface{}{
+				"event": "bts:subscribe",
+				"data":  map[string]string{"channel": "order_book_" + strings.ToLower(symbol+fiat)},
+			}
+			if err := conn.WriteJSON(subscribe); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func handleBitstampMessage(data []byte) error {
+	receivedTime := clockNow()
+
+	event, _ := jsonparser.GetString(data, "event")
+	switch event {
+	case "data":
+	case "bts:request_reconnect":
+		return fmt.Errorf("bitstamp requested a reconnect")
+	case "bts:error":
+		message, _ := jsonparser.GetString(data, "data", "message")
+		return fmt.Errorf("bitstamp websocket error : %s", message)
+	default:
+		return nil
+	}
+
+	channel, err := jsonparser.GetString(data, "channel")
+	if err != nil {
+		return fmt.Errorf("failed to read the channel from the Bitstamp stream data : %s", err)
+	}
+	pair := strings.ToUpper(strings.TrimPrefix(channel, "order_book_"))
+
+	var symbol, fiat string
+	for _, s := range bitstampCurrencies {
+		for _, f := range referenceFiats {
+			if s+f == pair {
+				symbol, fiat = s, f
+			}
+		}
+	}
+	if symbol == "" {
+		return nil
+	}
+
+	pAsk, err := getJSONFloat(data, "data", "asks", "[0]", "[0]")
+	if err != nil {
+		return fmt.Errorf("failed to read the %s ask price from the Bitstamp stream data: %s", pair, err)
+	}
+	pBid, err := getJSONFloat(data, "data", "bids", "[0]", "[0]")
+	if err != nil {
+		return fmt.Errorf("failed to read the %s bid price from the Bitstamp stream data: %s", pair, err)
+	}
+
+	bitstampBook.set(Price{Exchange: BITSTAMP, Currency: fiat, ID: symbol, Ask: pAsk, Bid: pBid})
+	bitstampBook.publish(receivedTime, []string{symbol})
+	return nil
+}
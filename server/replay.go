@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+)
+
+const (
+	DEFAULT_REPLAY_SPEED = 1.0
+	// MAX_CAPTURE_LINE bounds a single capture record, a full ticker response fits well within it.
+	MAX_CAPTURE_LINE = 16 << 20
+)
+
+// replayer drives the server from a capture instead of the venues. Every client and feed is sent to it: an HTTP
+// request gets the response recorded last before the current capture time, a websocket gets the frames recorded
+// after it at their recorded pace. The server runs on the capture time, which starts at the first record and runs
+// speed times faster than the wall clock, so exchange timestamps are as fresh as they were when captured.
+//
+// Nothing leaves the process during a replay, alerts go to the replayer and are only logged.
+type replayer struct {
+	speed float64
+	first time.Time
+	last  time.Time
+	clock *scaledClock
+
+	// responses are keyed by name, method and URL without scheme and host, frames by feed name. Both are sorted by
+	// time.
+	responses map[string][]CaptureRecord
+	frames    map[string][]CaptureRecord
+}
+
+// loadCapture reads a capture file, or every capture file of a directory in the order they were written.
+func loadCapture(path string, speed float64) (*replayer, error) {
+	files := []string{path}
+	if info, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to read capture %s : %s", path, err)
+	} else if info.IsDir() {
+		if files, err = captureFiles(path); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &replayer{speed: speed, responses: map[string][]CaptureRecord{}, frames: map[string][]CaptureRecord{}}
+	count := 0
+	for _, file := range files {
+		n, err := r.load(file)
+		if err != nil {
+			return nil, err
+		}
+		count += n
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("failed to read capture %s : no records", path)
+	}
+
+	for _, records := range r.responses {
+		sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	}
+	for _, records := range r.frames {
+		sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	}
+	return r, nil
+}
+
+func (r *replayer) load(name string) (int, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open capture file %s : %s", name, err)
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, MAX_CAPTURE_LINE)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var record CaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return count, fmt.Errorf("failed to parse capture file %s line %d : %s", name, line, err)
+		}
+		switch record.Kind {
+		case CAPTURE_HTTP:
+			key, err := replayKey(record.Name, record.Method, record.URL)
+			if err != nil {
+				return count, fmt.Errorf("failed to parse capture file %s line %d : %s", name, line, err)
+			}
+			r.responses[key] = append(r.responses[key], record)
+		case CAPTURE_WS:
+			r.frames[record.Name] = append(r.frames[record.Name], record)
+		default:
+			return count, fmt.Errorf("failed to parse capture file %s line %d : unknown kind %q", name, line, record.Kind)
+		}
+
+		if r.first.IsZero() || record.Time.Before(r.first) {
+			r.first = record.Time
+		}
+		if record.Time.After(r.last) {
+			r.last = record.Time
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, fmt.Errorf("failed to read capture file %s : %s", name, err)
+	}
+	return count, nil
+}
+
+// replayKey identifies the responses of one request. Scheme and host are left out, so a capture taken against a
+// staging venue replays the same.
+func replayKey(name, method, uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	return name + " " + method + " " + u.RequestURI(), nil
+}
+
+// now is the current capture time.
+func (r *replayer) now() time.Time {
+	return r.clock.now()
+}
+
+// wallTime is when the record of the given capture time is due.
+func (r *replayer) wallTime(t time.Time) time.Time {
+	return r.clock.started.Add(time.Duration(float64(t.Sub(r.first)) / r.speed))
+}
+
+// ServeHTTP answers <name>/<path> the way the venue name answered <path> at the current capture time.
+func (r *replayer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	name, path := parts[0], "/"
+	if len(parts) == 2 {
+		path += parts[1]
+	}
+
+	if ws.IsWebSocketUpgrade(req) {
+		r.serveFrames(w, req, name)
+		return
+	}
+	if name == PUSHOVER {
+		req.ParseForm()
+		alertLog.Info("alert replayed, not sent", "message", req.PostForm.Get("message"))
+		w.Write([]byte(`{"status": 1}`))
+		return
+	}
+
+	target := path
+	if req.URL.RawQuery != "" {
+		target += "?" + req.URL.RawQuery
+	}
+	key, _ := replayKey(name, req.Method, target)
+	records := r.responses[key]
+	if len(records) == 0 {
+		captureLog.Warn("request not in the capture", "name", name, "method", req.Method, "url", target)
+		http.Error(w, "not in the capture", http.StatusNotFound)
+		return
+	}
+
+	now := r.now()
+	record := records[0]
+	for _, candidate := range records {
+		if candidate.Time.After(now) {
+			break
+		}
+		record = candidate
+	}
+	w.WriteHeader(record.Status)
+	w.Write([]byte(record.Data))
+}
+
+// serveFrames sends the frames of a feed recorded after the current capture time, each at its time. Once the
+// capture is exhausted the connection stays open and silent, as a venue that stopped sending.
+func (r *replayer) serveFrames(w http.ResponseWriter, req *http.Request, name string) {
+	upgrader := ws.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// Subscriptions are read and ignored, the capture only holds what the venue sent.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	frames := r.frames[name]
+	now := r.now()
+	next := sort.Search(len(frames), func(i int) bool { return !frames[i].Time.Before(now) })
+	for _, frame := range frames[next:] {
+		timer := time.NewTimer(time.Until(r.wallTime(frame.Time)))
+		select {
+		case <-closed:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := conn.WriteMessage(ws.TextMessage, []byte(frame.Data)); err != nil {
+			return
+		}
+	}
+	<-closed
+}
+
+// startReplay serves the capture at path on a local port and sends every client and feed there. It stops when ctx
+// is cancelled. REPLAY_SPEED speeds the replay up, 10 plays ten captured seconds per second. Alerts of a replay are
+// recorded like any other, so ALERT_HISTORY_FILE should point away from the production history.
+func startReplay(ctx context.Context, path string) error {
+	speed := DEFAULT_REPLAY_SPEED
+	if value := os.Getenv("REPLAY_SPEED"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || !(parsed > 0) {
+			return fmt.Errorf("failed to start the replay : invalid REPLAY_SPEED %q", value)
+		}
+		speed = parsed
+	}
+
+	r, err := loadCapture(path, speed)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to start the replay : %s", err)
+	}
+	server := &http.Server{Handler: r}
+	r.clock = newScaledClock(r.first, speed)
+	setClock(r.clock)
+	go server.Serve(listener)
+	go func() {
+		end := time.NewTimer(time.Until(r.wallTime(r.last)))
+		defer end.Stop()
+		select {
+		case <-ctx.Done():
+		case <-end.C:
+			captureLog.Info("capture replayed to the end", "path", path)
+			<-ctx.Done()
+		}
+		server.Close()
+	}()
+
+	redirectAllBaseURLs(&url.URL{Scheme: "http", Host: listener.Addr().String(), Path: "/"})
+	// Alerts are only sent with credentials, placeholders take them to the replayer when there are none.
+	if PUSHOVER_USER == "" || PUSHOVER_APP_TOKEN == "" {
+		PUSHOVER_USER, PUSHOVER_APP_TOKEN = "replay", "replay"
+	}
+	// The rates are only fetched with a key, the replayer answers without one.
+	if fxAPIKey == "" {
+		fxAPIKey = "replay"
+	}
+	captureLog.Info("replaying capture", "path", path, "from", r.first, "to", r.last, "speed", speed)
+	return nil
+}
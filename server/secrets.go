@@ -0,0 +1,302 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	FX_API_KEY = "FX_API_KEY"
+
+	// MIN_REDACTED_LENGTH keeps short values like "1" from being redacted all over the logs.
+	MIN_REDACTED_LENGTH = 6
+	REDACTED            = "[REDACTED]"
+
+	KEYSTORE_SALT_SIZE  = 16
+	KEYSTORE_ITERATIONS = 600000
+)
+
+var (
+	// secretProviders are asked in order, the first one holding a secret wins. Environment variables always come
+	// first, SECRETS_DIR adds a directory mounted by the platform with one file per secret and SECRETS_KEYSTORE an
+	// encrypted keystore unlocked with SECRETS_KEYSTORE_PASSPHRASE.
+	secretProviders     []secretProvider
+	secretProviderErr   error
+	secretProvidersOnce sync.Once
+
+	// redactions are the secret values handed out so far, removed from every log line.
+	redactions   []string
+	redactionMux sync.RWMutex
+
+	// fxAPIKey is the apilayer key of the rates request.
+	fxAPIKey string
+)
+
+// secretProvider is a source of secrets keyed by their environment variable names.
+type secretProvider interface {
+	name() string
+	lookup(key string) (string, bool)
+}
+
+type envSecrets struct{}
+
+func (envSecrets) name() string { return "env" }
+
+func (envSecrets) lookup(key string) (string, bool) {
+	value := os.Getenv(key)
+	return value, value != ""
+}
+
+// fileSecrets reads a directory with one file per secret, the way Docker and Kubernetes mount them.
+type fileSecrets struct {
+	dir string
+}
+
+func (s fileSecrets) name() string { return "file" }
+
+func (s fileSecrets) lookup(key string) (string, bool) {
+	data, err := os.ReadFile(filepath.Join(s.dir, key))
+	if err != nil {
+		return "", false
+	}
+	value := strings.TrimSpace(string(data))
+	return value, value != ""
+}
+
+// keystoreSecrets is a JSON object of secrets encrypted with AES-GCM under a key derived from a passphrase, see
+// WriteKeystore.
+type keystoreSecrets struct {
+	values map[string]string
+}
+
+func (s keystoreSecrets) name() string { return "keystore" }
+
+func (s keystoreSecrets) lookup(key string) (string, bool) {
+	value, ok := s.values[key]
+	return value, ok && value != ""
+}
+
+// keystoreFile is the on-disk format of the keystore.
+type keystoreFile struct {
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func keystoreCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, KEYSTORE_ITERATIONS, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive the keystore key : %s", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the keystore cipher : %s", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func openKeystore(path, passphrase string) (keystoreSecrets, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return keystoreSecrets{}, fmt.Errorf("failed to read keystore %s : %s", path, err)
+	}
+
+	var file keystoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return keystoreSecrets{}, fmt.Errorf("failed to decode keystore %s : %s", path, err)
+	}
+
+	aead, err := keystoreCipher(passphrase, file.Salt)
+	if err != nil {
+		return keystoreSecrets{}, err
+	}
+	if len(file.Nonce) != aead.NonceSize() {
+		return keystoreSecrets{}, fmt.Errorf("failed to decode keystore %s : invalid nonce", path)
+	}
+	plaintext, err := aead.Open(nil, file.Nonce, file.Ciphertext, nil)
+	if err != nil {
+		return keystoreSecrets{}, fmt.Errorf("failed to decrypt keystore %s : wrong passphrase or corrupt file", path)
+	}
+
+	values := map[string]string{}
+	if err := json.Unmarshal(plaintext, &values); err != nil {
+		return keystoreSecrets{}, fmt.Errorf("failed to decode keystore %s : %s", path, err)
+	}
+	return keystoreSecrets{values: values}, nil
+}
+
+// WriteKeystore encrypts the JSON object of secrets read from r into a keystore at path.
+func WriteKeystore(path, passphrase string, r io.Reader) error {
+	if passphrase == "" {
+		return errors.New("failed to write keystore : empty passphrase")
+	}
+
+	var values map[string]string
+	if err := json.NewDecoder(r).Decode(&values); err != nil {
+		return fmt.Errorf("failed to read the secrets, expected a JSON object of strings : %s", err)
+	}
+	plaintext, err := json.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("failed to encode the secrets : %s", err)
+	}
+
+	file := keystoreFile{Salt: make([]byte, KEYSTORE_SALT_SIZE)}
+	if _, err := rand.Read(file.Salt); err != nil {
+		return fmt.Errorf("failed to create the keystore salt : %s", err)
+	}
+	aead, err := keystoreCipher(passphrase, file.Salt)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return fmt.Errorf("failed to create the keystore nonce : %s", err)
+	}
+	file.Ciphertext = aead.Seal(nil, file.Nonce, plaintext, nil)
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("failed to encode keystore : %s", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write keystore %s : %s", path, err)
+	}
+	return nil
+}
+
+func loadSecretProviders() {
+	secretProviders = []secretProvider{envSecrets{}}
+	if dir := os.Getenv("SECRETS_DIR"); dir != "" {
+		secretProviders = append(secretProviders, fileSecrets{dir: dir})
+	}
+	if path := os.Getenv("SECRETS_KEYSTORE"); path != "" {
+		keystore, err := openKeystore(path, os.Getenv("SECRETS_KEYSTORE_PASSPHRASE"))
+		if err != nil {
+			secretProviderErr = err
+			return
+		}
+		secretProviders = append(secretProviders, keystore)
+	}
+}
+
+// lookupSecret returns the secret from the first provider that has it and registers its value for redaction.
+func lookupSecret(key string) string {
+	secretProvidersOnce.Do(loadSecretProviders)
+
+	for _, provider := range secretProviders {
+		if value, ok := provider.lookup(key); ok {
+			addRedaction(value)
+			configLog.Debug("secret loaded", "name", key, "provider", provider.name())
+			return value
+		}
+	}
+	return ""
+}
+
+func addRedaction(value string) {
+	if len(value) < MIN_REDACTED_LENGTH {
+		return
+	}
+
+	redactionMux.Lock()
+	defer redactionMux.Unlock()
+	for _, existing := range redactions {
+		if existing == value {
+			return
+		}
+	}
+	redactions = append(redactions, value)
+	// Longer values first, so a secret containing another one is removed as a whole.
+	sort.Slice(redactions, func(i, j int) bool { return len(redactions[i]) > len(redactions[j]) })
+}
+
+// redact replaces every known secret value in s.
+func redact(s string) string {
+	redactionMux.RLock()
+	defer redactionMux.RUnlock()
+
+	for _, value := range redactions {
+		if strings.Contains(s, value) {
+			s = strings.ReplaceAll(s, value, REDACTED)
+		}
+	}
+	return s
+}
+
+// exchangeVariable is the name of a setting of an exchange, e.g. BTCTURK_API_KEY for its trading key.
+func exchangeVariable(exchange, suffix string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return -1
+	}, exchange)
+	return name + "_" + suffix
+}
+
+// ExchangeCredentials are the trading keys of an exchange.
+type ExchangeCredentials struct {
+	Key    string
+	Secret string
+}
+
+// exchangeCredentials returns the trading keys of an exchange, set with <EXCHANGE>_API_KEY and
+// <EXCHANGE>_API_SECRET.
+func exchangeCredentials(exchange string) (ExchangeCredentials, bool) {
+	credentials := ExchangeCredentials{
+		Key:    lookupSecret(exchangeVariable(exchange, "API_KEY")),
+		Secret: lookupSecret(exchangeVariable(exchange, "API_SECRET")),
+	}
+	return credentials, credentials.Key != "" && credentials.Secret != ""
+}
+
+// loadSecrets reads the secrets the server needs and reports every missing or inconsistent one. Optional secrets
+// come in pairs that must be set together.
+func loadSecrets() error {
+	var problems []string
+	secretProvidersOnce.Do(loadSecretProviders)
+	if secretProviderErr != nil {
+		problems = append(problems, secretProviderErr.Error())
+	}
+
+	// Without rates no premium is computed, but the dashboard, the reference and the venue health still work.
+	fxAPIKey = lookupSecret(FX_API_KEY)
+	if fxAPIKey == "" {
+		configLog.Warn("no FX_API_KEY, the FX rates are disabled and no premium is computed", "name", FX_API_KEY)
+	}
+
+	PUSHOVER_USER = lookupSecret("PUSHOVER_USER")
+	PUSHOVER_APP_TOKEN = lookupSecret("PUSHOVER_APP_TOKEN")
+	switch {
+	case PUSHOVER_USER == "" && PUSHOVER_APP_TOKEN == "":
+		configLog.Warn("no PUSHOVER_USER and PUSHOVER_APP_TOKEN, alerts are recorded as failed")
+	case PUSHOVER_USER == "" || PUSHOVER_APP_TOKEN == "":
+		problems = append(problems, "PUSHOVER_USER and PUSHOVER_APP_TOKEN must be set together")
+	}
+
+	for _, status := range adapterStatuses() {
+		credentials, ok := exchangeCredentials(status.Name)
+		if !ok && (credentials.Key != "" || credentials.Secret != "") {
+			problems = append(problems, fmt.Sprintf("%s and %s must be set together",
+				exchangeVariable(status.Name, "API_KEY"), exchangeVariable(status.Name, "API_SECRET")))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("failed to load secrets : %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
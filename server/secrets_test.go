@@ -0,0 +1,69 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestKeystore writes a keystore and reads it back, with the right passphrase and a wrong one.
+func TestKeystore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.keystore")
+	secrets := `{"FX_API_KEY": "fx-key-123456", "PUSHOVER_USER": "pushover-user"}`
+	if err := WriteKeystore(path, "correct horse", strings.NewReader(secrets)); err != nil {
+		t.Fatalf("failed to write the keystore : %s", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the keystore to be readable by its owner only, got %s", info.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "fx-key-123456") {
+		t.Error("expected the keystore to hold no plain secret")
+	}
+
+	keystore, err := openKeystore(path, "correct horse")
+	if err != nil {
+		t.Fatalf("failed to open the keystore : %s", err)
+	}
+	if value, ok := keystore.lookup(FX_API_KEY); !ok || value != "fx-key-123456" {
+		t.Errorf("expected %s from the keystore, got %q", FX_API_KEY, value)
+	}
+	if _, ok := keystore.lookup("PUSHOVER_APP_TOKEN"); ok {
+		t.Error("expected no PUSHOVER_APP_TOKEN in the keystore")
+	}
+
+	if _, err := openKeystore(path, "wrong horse"); err == nil {
+		t.Error("expected a wrong passphrase to fail")
+	}
+}
+
+func TestWriteKeystoreInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.keystore")
+	tests := []struct {
+		name       string
+		passphrase string
+		secrets    string
+	}{
+		{name: "empty passphrase", secrets: `{"FX_API_KEY": "fx-key-123456"}`},
+		{name: "not an object", passphrase: "correct horse", secrets: `["fx-key-123456"]`},
+		{name: "not strings", passphrase: "correct horse", secrets: `{"FX_API_KEY": 123456}`},
+	}
+
+	for _, test := range tests {
+		if err := WriteKeystore(path, test.passphrase, strings.NewReader(test.secrets)); err == nil {
+			t.Errorf("%s : expected an error", test.name)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s : expected no keystore to be written", test.name)
+		}
+	}
+}
@@ -1,13 +1,18 @@
 package server
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -19,24 +24,19 @@ type Price struct {
 	ID       string
 	Ask      float64
 	Bid      float64
+	// Volume is the 24 hour volume in the base currency, zero when the venue does not report it.
+	Volume       float64
+	ExchangeTime time.Time
+	ReceivedTime time.Time
 }
 
 const (
-	BASE_CURRENCY_URI = "https://api.apilayer.com/exchangerates_data/latest?symbols=TRY&base=USD"
+	BASE_CURRENCY_URI = "https://api.apilayer.com/exchangerates_data/latest?symbols=%s&base=USD"
 )
 
 var (
-	diffs                                                                              map[string]float64
-	prices, spreads                                                                    map[string]float64
-	minDiffs, maxDiffs                                                                 map[string]float64
-	dogeVolumes                                                                        map[string]float64
-	minSymbol, maxSymbol                                                               map[string]string
-	coinbaseProPrices               				 																					 map[string]*Price
-	binancePrices, paribuPrices,btcTurkPrices, koinimPrices 					 								 []Price
-	fiatNotificationEnabled                                                            = true
-	warning                                                                            string
-
-	mux sync.Mutex
+	// pollCycle numbers the polling cycles of calculatePrices.
+	pollCycle uint64
 
 	ALL_SYMBOLS = []string{"BTC", "ETH", "LTC", "BCH", "ETC", "ZRX", "XLM", "EOS", "USDT", "DOGE", "LINK", "DASH", "ZEC", "MKR", "BAT", "ADA"}
 )
@@ -44,429 +44,482 @@ var (
 func Run() {
 	port := os.Getenv("PORT")
 	if port == "" {
-		log.Fatal("$PORT must be set")
+		logger.Error("$PORT must be set")
+		os.Exit(1)
+	}
+
+	// A replay never reaches the venues, so it runs without their secrets.
+	replayFile := os.Getenv("REPLAY_FILE")
+	if err := loadSecrets(); err != nil && replayFile == "" {
+		configLog.Error("cannot start", "error", err)
+		os.Exit(1)
+	} else if err != nil {
+		configLog.Warn("replaying without secrets", "error", err)
 	}
 
 	router := gin.New()
-	router.Use(gin.Logger())
+	router.Use(requestLogger)
 	router.LoadHTMLGlob("templates/*")
 
 	router.GET("/", PrintTable)
-	router.GET("/notification", SetNotificationLimits)
+	router.GET("/login", LoginPage)
+	router.POST("/login", Login)
+	router.GET("/api/alerts", GetAlerts)
+
+	// The settings pages and every change need a login.
+	settings := router.Group("/", requireLogin)
+	settings.POST("/logout", Logout)
+	settings.GET("/notification", NotificationPage)
+	settings.POST("/notification", SetNotificationLimits)
+	settings.POST("/notification/rollback", RollbackNotificationSettings)
+	settings.GET("/api/notification/versions", GetSettingsVersions)
+	settings.GET("/alerts", ListAlerts)
+	settings.POST("/alerts/ack", AcknowledgeAlert)
+	settings.POST("/alerts/snooze", SnoozeAlert)
+	settings.POST("/alerts/clear", ClearAlertAck)
+	settings.GET("/exchanges", ListExchanges)
+	settings.POST("/exchanges/toggle", ToggleExchange)
+	settings.GET("/api/audit", GetAuditLog)
+	router.GET("/api/latency", GetLatency)
+	router.GET("/api/reference", GetReference)
+	router.GET("/api/index", GetIndex)
+	router.GET("/api/quality", GetQuality)
+	router.GET("/metrics", GetMetrics)
+	router.GET("/api/errors", GetRecentErrors)
+	router.GET("/healthz", Healthz)
+	router.GET("/readyz", Readyz)
+	router.GET("/api/premium", GetPremiumIndex)
+	router.GET("/api/liquidity", GetLiquidity)
+	router.GET("/api/opportunities", GetOpportunities)
+
+	if err := loadAlertHistory(); err != nil {
+		alertLog.Error("cannot load the alert history", "error", err)
+	}
+	if err := loadAuditLog(); err != nil {
+		auditLog.Error("cannot load the audit log", "error", err)
+	}
+	if err := loadNotificationSettings(); err != nil {
+		configLog.Error("cannot load the notification settings, using the defaults", "error", err)
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		router.Run(":" + port)
-	}()
+	// SIGTERM, as sent by Heroku, or an interrupt stops every loop and the HTTP server.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	setRequestContext(ctx)
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		getCurrencies()
-	}()
+	if replayFile != "" {
+		if err := startReplay(ctx, replayFile); err != nil {
+			captureLog.Error("cannot start", "error", err)
+			os.Exit(1)
+		}
+	}
 
-	wg.Add(1)
+	var background loops
+	background.start(ctx, "currencies", getCurrencies)
+	background.start(ctx, GDAX, startCoinbaseProWS)
+	background.start(ctx, BINANCE, startBinanceWS)
+	background.start(ctx, BTCTURK, startBTCTurkWS)
+	background.start(ctx, PARIBU, startParibuWS)
+	background.start(ctx, KRAKEN, startKrakenWS)
+	background.start(ctx, BITSTAMP, startBitstampWS)
+	background.start(ctx, "prices", getPrices)
+	background.start(ctx, "diffs", calculateDiffs)
+	background.start(ctx, "depths", getDepths)
+	background.start(ctx, "adapters", checkAdapters)
+	background.start(ctx, "premium", samplePremiumIndex)
+	background.start(ctx, "alert history", persistAlertHistory)
+
+	server := &http.Server{Addr: ":" + port, Handler: router}
+	serveErr := make(chan error, 1)
 	go func() {
-		defer wg.Done()
-		startCoinbaseProWS()
+		serveErr <- server.ListenAndServe()
 	}()
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		getPrices()
-	}()
+	failed := false
+	select {
+	case <-ctx.Done():
+	case err := <-serveErr:
+		logger.Error("http server failed", "error", err)
+		failed = true
+		stop()
+	}
+	logger.Info("shutting down")
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		calculateDiffs()
-	}()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
 
-	wg.Wait()
-}
+	// The server stops accepting requests and lets the ones in flight finish, meanwhile the loops return. The diff
+	// loop evaluates the quotes that are still queued, so pending alerts are sent before the history is saved.
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		httpLog.Warn("cannot shut the http server down", "error", err)
+	}
+	if !background.wait(shutdownCtx) {
+		logger.Warn("background loops did not stop in time", "timeout", SHUTDOWN_TIMEOUT)
+	}
+	if err := flushAlertHistory(); err != nil {
+		alertLog.Error("cannot save the alert history", "error", err)
+	}
+	capture.close()
 
-func getPrices() {
-	for {
-		calculatePrices()
-		time.Sleep(2 * time.Second)
+	logger.Info("stopped")
+	if failed {
+		os.Exit(1)
 	}
 }
 
-func calculateDiffs() {
+func getPrices(ctx context.Context) {
 	for {
-		findAltcoinPrices(binancePrices, paribuPrices, btcTurkPrices, koinimPrices)
-		sendMessages()
-		resetDiffsAndSymbols()
-		time.Sleep(1 * time.Second)
+		calculatePrices(ctx)
+		if !sleepContext(ctx, 2*time.Second) {
+			return
+		}
 	}
 }
 
-func calculatePrices() {
-	var err error
+// calculatePrices polls every TRY venue. A venue that fails keeps its last quotes, which go stale and drop out of
+// the diffs once they are older than the venue's maximum quote age. Every poll cycle is numbered so the log lines
+// of one cycle can be told apart.
+func calculatePrices(ctx context.Context) {
+	cycleLog := adapterLog.With("cycle", atomic.AddUint64(&pollCycle, 1))
 
 	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
+	poll := func(exchange string, a *adapter) {
 		defer wg.Done()
-		binancePrices, err = getBinancePrices()
-		if err != nil {
-			message := fmt.Sprintf("Error reading Binance prices : %s", err)
-			warning += message + "\n"
-			fmt.Println(message)
-			log.Println(message)
+		start := time.Now()
+		list, err := a.getPrices()
+		if ctx.Err() != nil {
+			// Polls cut short by shutdown say nothing about the venue.
+			return
 		}
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		paribuPrices, err = getParibuPrices()
+		fetchDuration.observe(time.Since(start), exchange)
+		a.observe(list, err, false)
 		if err != nil {
-			message := fmt.Sprintf("Error reading Paribu prices : %s", err)
-			warning += message + "\n"
-			fmt.Println(message)
-			log.Println(message)
+			fetchErrors.add(1, exchange)
+			cycleLog.Warn("cannot read prices", "exchange", exchange, "duration", time.Since(start), "error", err)
+			return
 		}
-	}()
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		btcTurkPrices, err = getBTCTurkPrices()
-		if err != nil {
-			message := fmt.Sprintf("Error reading BTCTurk prices : %s", err)
-			warning += message + "\n"
-			fmt.Println(message)
-			log.Println(message)
-		}
-	}()
+		// Rejected quotes are left out but their symbols are still recalculated, so their old diffs are dropped.
+		a.publish(exchange, validateQuotes(exchange, list), quoteSymbols(list), clockNow())
+	}
 
-	/*wg.Add(1)
-	go func() {
-		defer wg.Done()
-		koineksPrices, err = getKoineksPrices()
-		if err != nil {
-			message := fmt.Sprintf("Error reading Koineks prices : %s", err)
-			warning += message + "\n"
-			fmt.Println(message)
-			log.Println(message)
+	// Streamed venues are only polled as the fallback of their stream.
+	for _, status := range adapterStatuses() {
+		if status.State != ADAPTER_ENABLED || (status.Streamed && feedConnected(status.Name)) {
+			continue
 		}
-	}()*/
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		koinimPrices, err = getKoinimPrices()
-		if err != nil {
-			message := fmt.Sprintf("Error reading Koinim prices : %s", err)
-			warning += message + "\n"
-			fmt.Println(message)
-			log.Println(message)
-		}
-	}()
+		a, _ := getAdapter(status.Name)
+		wg.Add(1)
+		go poll(status.Name, a)
+	}
+	wg.Wait()
+}
 
-	/*wg.Add(1)
-	go func() {
-		defer wg.Done()
-		vebitcoinPrices, err = getVebitcoinPrices()
-		if err != nil {
-			message := fmt.Sprintf("Error reading Vebitcoin prices : %s", err)
-			warning += message + "\n"
-			fmt.Println(message)
-			log.Println(message)
-		}
-	}()
+func PrintTable(c *gin.Context) {
+	printTable(c)
+}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := getBittrexDOGEVolumes(); err != nil {
-			message := fmt.Sprintf("Error reading Bittrex DOGE volumes : %s", err)
-			warning += message + "\n"
-			fmt.Println(message)
-			log.Println(message)
+func printTable(c *gin.Context) {
+	now := clockNow()
+	snapshot := market.snapshot()
+	referenceLive := feedConnected(GDAX)
+
+	corridor := strings.ToUpper(c.DefaultQuery("corridor", DEFAULT_CORRIDOR))
+	if !isCorridor(corridor) {
+		c.String(http.StatusBadRequest, fmt.Sprintf("unknown corridor %q", corridor))
+		return
+	}
+	exchanges := corridorExchanges(snapshot, corridor)
+
+	var rows []dashboardRow
+	for _, symbol := range dashboardSymbols {
+		// The reference column shows what the diffs are computed against, the other column the alternative.
+		reference, referenceStale := diffReference(snapshot, symbol, now, referenceLive)
+		row := dashboardRow{
+			Symbol:         symbol,
+			Reference:      formatReferencePrice(symbol, reference.Ask),
+			Spread:         fmt.Sprintf("%.2f", referenceSpread(reference)),
+			ReferenceStale: referenceStale,
+			ReferenceAge:   formatAge(reference.Age(now)),
+			Alternative:    "-",
+		}
+		if referenceSource == REFERENCE_COMPOSITE {
+			row.Reference = formatCompositePrice(symbol, reference.Ask)
+			if coinbase, ok := snapshot.Reference[symbol]; ok {
+				row.Alternative = formatReferencePrice(symbol, coinbase.Ask)
+			}
+		} else if composite, ok := snapshot.Composite[symbol]; ok {
+			row.Alternative = formatCompositePrice(symbol, composite.Ask)
 		}
 
-		if err := getBinanceDOGEVolumes(); err != nil {
-			message := fmt.Sprintf("Error reading Binance DOGE volumes : %s", err)
-			warning += message + "\n"
-			fmt.Println(message)
-			log.Println(message)
+		for _, exchange := range exchanges {
+			quote, ok := snapshot.LastQuotes[fmt.Sprintf("%s-%s", exchange, symbol)]
+			if !ok || quote.Currency != corridor {
+				row.Cells = append(row.Cells, dashboardCell{})
+				continue
+			}
+
+			askDiff, hasDiff := snapshot.Diffs[fmt.Sprintf("%s-%s-%s-%s", GDAX, exchange, symbol, "Ask")]
+			row.Cells = append(row.Cells, dashboardCell{
+				Available: true,
+				HasDiff:   hasDiff,
+				AskDiff:   askDiff,
+				BidDiff:   snapshot.Diffs[fmt.Sprintf("%s-%s-%s-%s", GDAX, exchange, symbol, "Bid")],
+				AskPrice:  quote.Ask,
+				BidPrice:  quote.Bid,
+				Stale:     quote.Stale(now),
+				Age:       formatAge(quote.Age(now)),
+			})
 		}
-	}()*/
-	wg.Wait()
-}
+		rows = append(rows, row)
+	}
 
-func findAltcoinPrices(sellExchanges ...[]Price) {
-	var newPriceList [][]Price
-	for _, list := range sellExchanges {
-		newPriceList = append(newPriceList, list)
+	var headers []string
+	for _, exchange := range exchanges {
+		headers = append(headers, dashboardTitle(exchange))
 	}
-	findPriceDifferences(newPriceList...)
+
+	c.HTML(http.StatusOK, "index.tmpl", gin.H{
+		"Corridor":      corridor,
+		"Corridors":     corridors,
+		"Rate":          snapshot.rate(corridor),
+		"Implied":       snapshot.Implied[corridor],
+		"FXSource":      fxSource,
+		"Exchanges":     headers,
+		"Rows":          rows,
+		"Warnings":      dashboardWarnings(now),
+		"Feeds":         feedStatuses(),
+		"Latency":       quoteToDiffLatency.summary(),
+		"Opportunities": topOpportunities(snapshot, DASHBOARD_OPPORTUNITIES),
+		"Divergences":   referenceWarnings(snapshot),
+		"Source":        referenceSource,
+		"Alternative":   alternativeTitle(),
+	})
 }
 
-func PrintTable(c *gin.Context) {
-	printTable(c)
+func NotificationPage(c *gin.Context) {
+	renderNotificationPage(c, http.StatusOK, currentNotificationSettings(), "")
 }
 
-func printTable(c *gin.Context) {
-	mux.Lock()
-	c.HTML(http.StatusOK, "index.tmpl", gin.H{
-		"USDTRY":                tryRate,
-		"GdaxBTC":               coinbaseProPrices["BTC"].Ask,
-		"ParibuBTCAsk":          diffs[GDAX+"-Paribu-BTC-Ask"],
-		"ParibuBTCBid":          diffs[GDAX+"-Paribu-BTC-Bid"],
-		"BTCTurkBTCAsk":         diffs[GDAX+"-BTCTurk-BTC-Ask"],
-		"BTCTurkBTCBid":         diffs[GDAX+"-BTCTurk-BTC-Bid"],
-		"KoineksBTCAsk":         diffs[GDAX+"-Koineks-BTC-Ask"],
-		"KoineksBTCBid":         diffs[GDAX+"-Koineks-BTC-Bid"],
-		"KoinimBTCAsk":          diffs[GDAX+"-Koinim-BTC-Ask"],
-		"KoinimBTCBid":          diffs[GDAX+"-Koinim-BTC-Bid"],
-		"BinanceBTCAsk":       	 diffs[GDAX+"-Binance-BTC-Ask"],
-		"BinanceBTCBid":       	 diffs[GDAX+"-Binance-BTC-Bid"],
-		"GdaxETH":               coinbaseProPrices["ETH"].Ask,
-		"ParibuETHAsk":          diffs[GDAX+"-Paribu-ETH-Ask"],
-		"ParibuETHBid":          diffs[GDAX+"-Paribu-ETH-Bid"],
-		"BTCTurkETHAsk":         diffs[GDAX+"-BTCTurk-ETH-Ask"],
-		"BTCTurkETHBid":         diffs[GDAX+"-BTCTurk-ETH-Bid"],
-		"KoinimETHAsk":          diffs[GDAX+"-Koinim-ETH-Ask"],
-		"KoinimETHBid":          diffs[GDAX+"-Koinim-ETH-Bid"],
-		"BinanceETHAsk":       	 diffs[GDAX+"-Binance-ETH-Ask"],
-		"BinanceETHBid":       	 diffs[GDAX+"-Binance-ETH-Bid"],
-		"GdaxLTC":               coinbaseProPrices["LTC"].Ask,
-		"ParibuLTCAsk":          diffs[GDAX+"-Paribu-LTC-Ask"],
-		"ParibuLTCBid":          diffs[GDAX+"-Paribu-LTC-Bid"],
-		"BTCTurkLTCAsk":         diffs[GDAX+"-BTCTurk-LTC-Ask"],
-		"BTCTurkLTCBid":         diffs[GDAX+"-BTCTurk-LTC-Bid"],
-		"KoinimLTCAsk":          diffs[GDAX+"-Koinim-LTC-Ask"],
-		"KoinimLTCBid":          diffs[GDAX+"-Koinim-LTC-Bid"],
-		"GdaxBCH":               coinbaseProPrices["BCH"].Ask,
-		"BCHSpread":             fmt.Sprintf("%.2f", spreads[GDAX+"BCH"]),
-		"ParibuBCHAsk":          diffs[GDAX+"-Paribu-BCH-Ask"],
-		"ParibuBCHBid":          diffs[GDAX+"-Paribu-BCH-Bid"],
-		"KoinimBCHAsk":          diffs[GDAX+"-Koinim-BCH-Ask"],
-		"KoinimBCHBid":          diffs[GDAX+"-Koinim-BCH-Bid"],
-		"GdaxETC":               coinbaseProPrices["ETC"].Ask,
-		"ETCSpread":             fmt.Sprintf("%.2f", spreads[GDAX+"ETC"]),
-		"BinanceETCAsk":         diffs[GDAX+"-Binance-ETC-Ask"],
-		"BinanceETCBid":         diffs[GDAX+"-Binance-ETC-Bid"],
-		"GdaxXLM":               coinbaseProPrices["XLM"].Ask,
-		"XLMSpread":             fmt.Sprintf("%.2f", spreads[GDAX+"XLM"]),
-		"ParibuXLMAsk":          diffs[GDAX+"-Paribu-XLM-Ask"],
-		"ParibuXLMBid":          diffs[GDAX+"-Paribu-XLM-Bid"],
-		"BTCTurkXLMAsk":         diffs[GDAX+"-BTCTurk-XLM-Ask"],
-		"BTCTurkXLMBid":         diffs[GDAX+"-BTCTurk-XLM-Bid"],
-		"BinanceXLMAsk":       	 diffs[GDAX+"-Binance-XLM-Ask"],
-		"BinanceXLMBid":       	 diffs[GDAX+"-Binance-XLM-Bid"],
-		"GdaxEOS":               coinbaseProPrices["EOS"].Ask,
-		"EOSSpread":             fmt.Sprintf("%.2f", spreads[GDAX+"EOS"]),
-		"ParibuEOSAsk":          diffs[GDAX+"-Paribu-EOS-Ask"],
-		"ParibuEOSBid":          diffs[GDAX+"-Paribu-EOS-Bid"],
-		"BinanceEOSAsk":       	 diffs[GDAX+"-Binance-EOS-Ask"],
-		"BinanceEOSBid":         diffs[GDAX+"-Binance-EOS-Bid"],
-		"GdaxLINK":               coinbaseProPrices["LINK"].Ask,
-		"LINKSpread":             fmt.Sprintf("%.2f", spreads[GDAX+"LINK"]),
-		"ParibuLINKAsk":          diffs[GDAX+"-Paribu-LINK-Ask"],
-		"ParibuLINKBid":          diffs[GDAX+"-Paribu-LINK-Bid"],
-		"BinanceLINKAsk":       	diffs[GDAX+"-Binance-LINK-Ask"],
-		"BinanceLINKBid":       	diffs[GDAX+"-Binance-LINK-Bid"],
-		"BTCTurkLINKAsk":         diffs[GDAX+"-BTCTurk-LINK-Ask"],
-		"BTCTurkLINKBid":         diffs[GDAX+"-BTCTurk-LINK-Bid"],
-		"GdaxDASH":              coinbaseProPrices["DASH"].Ask,
-		"DASHSpread":            fmt.Sprintf("%.2f", spreads[GDAX+"DASH"]),
-		"KoinimDASHAsk":      	 diffs[GDAX+"-Koinim-DASH-Ask"],
-		"KoinimDASHBid":      	 diffs[GDAX+"-Koinim-DASH-Bid"],
-		"GdaxMKR":              coinbaseProPrices["MKR"].Ask,
-		"MKRSpread":            fmt.Sprintf("%.2f", spreads[GDAX+"MKR"]),
-		"ParibuMKRAsk":          diffs[GDAX+"-Paribu-MKR-Ask"],
-		"ParibuMKRBid":          diffs[GDAX+"-Paribu-MKR-Bid"],
-		"GdaxADA":               coinbaseProPrices["ADA"].Ask,
-		"ADASpread":             fmt.Sprintf("%.2f", spreads[GDAX+"ADA"]),
-		"BinanceADAAsk":         diffs[GDAX+"-Binance-ADA-Ask"],
-		"BinanceADABid":         diffs[GDAX+"-Binance-ADA-Bid"],
-		"ParibuADAAsk":          diffs[GDAX+"-Paribu-ADA-Ask"],
-		"ParibuADABid":          diffs[GDAX+"-Paribu-ADA-Bid"],
-		"BTCTurkADAAsk":         diffs[GDAX+"-BTCTurk-ADA-Ask"],
-		"BTCTurkADABid":         diffs[GDAX+"-BTCTurk-ADA-Bid"],
-		"ParibuBTCAskPrice":     prices["Paribu-BTC-Ask"],
-		"ParibuBTCBidPrice":     prices["Paribu-BTC-Bid"],
-		"BTCTurkBTCAskPrice":    prices["BTCTurk-BTC-Ask"],
-		"BTCTurkBTCBidPrice":    prices["BTCTurk-BTC-Bid"],
-		"BinanceBTCAskPrice":    prices["Binance-BTC-Ask"],
-		"BinanceBTCBidPrice":    prices["Binance-BTC-Bid"],
-		"KoinimBTCAskPrice":     prices["Koinim-BTC-Ask"],
-		"KoinimBTCBidPrice":     prices["Koinim-BTC-Bid"],
-		"ParibuETHAskPrice":     prices["Paribu-ETH-Ask"],
-		"ParibuETHBidPrice":     prices["Paribu-ETH-Bid"],
-		"BTCTurkETHAskPrice":    prices["BTCTurk-ETH-Ask"],
-		"BTCTurkETHBidPrice":    prices["BTCTurk-ETH-Bid"],
-		"BinanceETHAskPrice":    prices["Binance-ETH-Ask"],
-		"BinanceETHBidPrice":    prices["Binance-ETH-Bid"],
-		"KoinimETHAskPrice":     prices["Koinim-ETH-Ask"],
-		"KoinimETHBidPrice":     prices["Koinim-ETH-Bid"],
-		"ParibuLTCAskPrice":     prices["Paribu-LTC-Ask"],
-		"ParibuLTCBidPrice":     prices["Paribu-LTC-Bid"],
-		"BTCTurkLTCAskPrice":    prices["BTCTurk-LTC-Ask"],
-		"BTCTurkLTCBidPrice":    prices["BTCTurk-LTC-Bid"],
-		"KoinimLTCAskPrice":     prices["Koinim-LTC-Ask"],
-		"KoinimLTCBidPrice":     prices["Koinim-LTC-Bid"],
-		"ParibuBCHAskPrice":     prices["Paribu-BCH-Ask"],
-		"ParibuBCHBidPrice":     prices["Paribu-BCH-Bid"],
-		"KoinimBCHAskPrice":     prices["Koinim-BCH-Ask"],
-		"KoinimBCHBidPrice":     prices["Koinim-BCH-Bid"],
-		"BinanceETCAskPrice":    prices["Binance-ETC-Ask"],
-		"BinanceETCBidPrice":    prices["Binance-ETC-Bid"],
-		"ParibuUSDTAskPrice":     prices["Paribu-USDT-Ask"],
-		"ParibuUSDTBidPrice":     prices["Paribu-USDT-Bid"],
-		"BTCTurkUSDTAskPrice":   prices["BTCTurk-USDT-Ask"],
-		"BTCTurkUSDTBidPrice":   prices["BTCTurk-USDT-Bid"],
-		"BinanceUSDTAskPrice":   prices["Binance-USDT-Ask"],
-		"BinanceUSDTBidPrice":   prices["Binance-USDT-Bid"],
-		"ParibuDOGEAskPrice":     prices["Paribu-DOGE-Ask"],
-		"ParibuDOGEBidPrice":     prices["Paribu-DOGE-Bid"],
-		"BinanceDOGEAskPrice":   prices["Binance-DOGE-Ask"],
-		"BinanceDOGEBidPrice":   prices["Binance-DOGE-Bid"],
-		"KoinimDOGEAskPrice":    prices["Koinim-DOGE-Ask"],
-		"KoinimDOGEBidPrice":    prices["Koinim-DOGE-Bid"],
-		"ParibuXLMAskPrice":     prices["Paribu-XLM-Ask"],
-		"ParibuXLMBidPrice":     prices["Paribu-XLM-Bid"],
-		"BTCTurkXLMAskPrice":    prices["BTCTurk-XLM-Ask"],
-		"BTCTurkXLMBidPrice":    prices["BTCTurk-XLM-Bid"],
-		"BinanceXLMAskPrice":    prices["Binance-XLM-Ask"],
-		"BinanceXLMBidPrice":    prices["Binance-XLM-Bid"],
-		"ParibuEOSAskPrice":     prices["Paribu-EOS-Ask"],
-		"ParibuEOSBidPrice":     prices["Paribu-EOS-Bid"],
-		"BinanceEOSAskPrice":    prices["Binance-EOS-Ask"],
-		"BinanceEOSBidPrice":    prices["Binance-EOS-Bid"],
-		"ParibuLINKAskPrice":     prices["Paribu-LINK-Ask"],
-		"ParibuLINKBidPrice":     prices["Paribu-LINK-Bid"],
-		"BTCTurkLINKAskPrice":    prices["BTCTurk-LINK-Ask"],
-		"BTCTurkLINKBidPrice":    prices["BTCTurk-LINK-Bid"],
-		"BinanceLINKAskPrice":    prices["Binance-LINK-Ask"],
-		"BinanceLINKBidPrice":    prices["Binance-LINK-Bid"],
-		"KoinimDASHAskPrice":    prices["Koinim-DASH-Ask"],
-		"KoinimDASHBidPrice":    prices["Koinim-DASH-Bid"],
-		"ParibuMKRAskPrice":     prices["Paribu-MKR-Ask"],
-		"ParibuMKRBidPrice":     prices["Paribu-MKR-Bid"],
-		"ParibuADAAskPrice":     prices["Paribu-ADA-Ask"],
-		"ParibuADABidPrice":     prices["Paribu-ADA-Bid"],
-		"BTCTurkADAAskPrice":     prices["BTCTurk-ADA-Ask"],
-		"BTCTurkADABidPrice":     prices["BTCTurk-ADA-Bid"],
-		"GdaxUSDT":              fmt.Sprintf("%.8f", coinbaseProPrices["USDT"].Ask),
-		"USDTSpread":            fmt.Sprintf("%.2f", spreads[GDAX+"USDT"]),
-		"ParibuUSDTAsk":         diffs[GDAX+"-Paribu-USDT-Ask"],
-		"ParibuUSDTBid":         diffs[GDAX+"-Paribu-USDT-Bid"],
-		"BTCTurkUSDTAsk":        diffs[GDAX+"-BTCTurk-USDT-Ask"],
-		"BTCTurkUSDTBid":        diffs[GDAX+"-BTCTurk-USDT-Bid"],
-		"BinanceUSDTAsk":        diffs[GDAX+"-Binance-USDT-Ask"],
-		"BinanceUSDTBid":        diffs[GDAX+"-Binance-USDT-Bid"],
-		"GdaxDOGE":              fmt.Sprintf("%.8f", coinbaseProPrices["DOGE"].Ask),
-		"DOGESpread":     		   fmt.Sprintf("%.2f", spreads[GDAX+"DOGE"]),
-		"ParibuDOGEAsk":         diffs[GDAX+"-Paribu-DOGE-Ask"],
-		"ParibuDOGEBid":         diffs[GDAX+"-Paribu-DOGE-Bid"],
-		"BinanceDOGEAsk":        diffs[GDAX+"-Binance-DOGE-Ask"],
-		"BinanceDOGEBid":        diffs[GDAX+"-Binance-DOGE-Bid"],
-		"KoinimDOGEAsk":         diffs[GDAX+"-Koinim-DOGE-Ask"],
-		"KoinimDOGEBid":         diffs[GDAX+"-Koinim-DOGE-Bid"],
-		"Warning":               warning,
+func renderNotificationPage(c *gin.Context, code int, settings NotificationSettings, errMessage string) {
+	c.HTML(code, "notification.tmpl", gin.H{
+		"Minimum":     settings.Minimum,
+		"Maximum":     settings.Maximum,
+		"Duration":    settings.Duration,
+		"PThreshold":  settings.PairThreshold,
+		"FiatEnabled": settings.FiatEnabled,
+		"PairEnabled": settings.PairEnabled,
+		"Versions":    recentSettingsVersions(SETTINGS_VERSIONS_SHOWN),
+		"User":        authUser(c),
+		"CSRF":        csrfToken(c),
+		"Error":       errMessage,
 	})
-	mux.Unlock()
 }
 
+// SetNotificationLimits changes the alert thresholds. Fields left empty keep their value; any invalid field rejects
+// the whole change with a 400.
 func SetNotificationLimits(c *gin.Context) {
-	minimumStr := c.Query("minimum")
-	maximumStr := c.Query("maximum")
-	durationStr := c.Query("duration")
-	fiatEnable := c.Query("fiatEnable")
-	pThresholdStr := c.Query("pThreshold")
-
-	if minimumStr != "" {
-		minimum, err := strconv.ParseFloat(minimumStr, 64)
-		if err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
-			return
-		}
+	current := currentNotificationSettings()
+	settings, err := parseNotificationSettings(c, current)
+	if err != nil {
+		renderNotificationPage(c, http.StatusBadRequest, current, err.Error())
+		return
+	}
 
-		MIN_NOTI_PERC = minimum
+	version, err := saveNotificationSettings(settings, authUser(c), 0)
+	if err != nil {
+		configLog.Error("cannot save the notification settings", "error", err)
+		renderNotificationPage(c, http.StatusInternalServerError, current, "The settings could not be saved")
+		return
 	}
 
-	if maximumStr != "" {
-		maximum, err := strconv.ParseFloat(maximumStr, 64)
-		if err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
-			return
-		}
+	details := append([]string{"version", strconv.Itoa(version.Version)}, settingsChanges(current, settings)...)
+	audit(c, authUser(c), "notification settings changed", details...)
+	renderNotificationPage(c, http.StatusOK, settings, "")
+}
 
-		MAX_NOTI_PERC = maximum
-	}
+// settingsChanges lists the changed fields for the audit log.
+func settingsChanges(old, new NotificationSettings) []string {
+	var details []string
+	details = auditChange(details, "minimum", old.Minimum, new.Minimum)
+	details = auditChange(details, "maximum", old.Maximum, new.Maximum)
+	details = auditChange(details, "duration", old.Duration, new.Duration)
+	details = auditChange(details, "pThreshold", old.PairThreshold, new.PairThreshold)
+	details = auditChange(details, "fiatEnable", old.FiatEnabled, new.FiatEnabled)
+	details = auditChange(details, "pairEnable", old.PairEnabled, new.PairEnabled)
+	return details
+}
 
-	if durationStr != "" {
-		duration, err := strconv.ParseFloat(durationStr, 64)
-		if err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
-			return
+func parseNotificationSettings(c *gin.Context, settings NotificationSettings) (NotificationSettings, error) {
+	for name, value := range map[string]*float64{
+		"minimum":    &settings.Minimum,
+		"maximum":    &settings.Maximum,
+		"duration":   &settings.Duration,
+		"pThreshold": &settings.PairThreshold,
+	} {
+		if err := parseSetting(c, name, value); err != nil {
+			return settings, err
 		}
-
-		DURATION = duration
 	}
 
-	if pThresholdStr != "" {
-		pThreshold, err := strconv.ParseFloat(pThresholdStr, 64)
-		if err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
-			return
-		}
+	if settings.Duration < 0 {
+		return settings, fmt.Errorf("duration must not be negative, got %v", settings.Duration)
+	}
+	if settings.PairThreshold < 0 {
+		return settings, fmt.Errorf("pThreshold must not be negative, got %v", settings.PairThreshold)
+	}
+	if settings.Minimum >= settings.Maximum {
+		return settings, fmt.Errorf("minimum %v must be below maximum %v", settings.Minimum, settings.Maximum)
+	}
 
-		PAIR_THRESHOLD = pThreshold
+	// A missing fiatEnable or pairEnable keeps the current state, only an explicit value switches alerts on or off.
+	if err := parseEnabled(c, "fiatEnable", &settings.FiatEnabled); err != nil {
+		return settings, err
+	}
+	if err := parseEnabled(c, "pairEnable", &settings.PairEnabled); err != nil {
+		return settings, err
 	}
 
-	switch fiatEnable {
+	return settings, nil
+}
+
+func parseEnabled(c *gin.Context, name string, enabled *bool) error {
+	switch value := c.PostForm(name); value {
+	case "":
 	case "true":
-		fiatNotificationEnabled = true
+		*enabled = true
 	case "false":
-		fiatNotificationEnabled = false
+		*enabled = false
 	default:
-		fiatNotificationEnabled = false
+		return fmt.Errorf("%s must be true or false, got %q", name, value)
+	}
+	return nil
+}
+
+// parseSetting sets value from the form field name, an empty field keeps it.
+func parseSetting(c *gin.Context, name string, value *float64) error {
+	valueStr := strings.TrimSpace(c.PostForm(name))
+	if valueStr == "" {
+		return nil
 	}
 
-	c.HTML(http.StatusOK, "notification.tmpl", gin.H{
-		"Minimum":    MIN_NOTI_PERC,
-		"Maximum":    MAX_NOTI_PERC,
-		"Duration":   DURATION,
-		"PThreshold": PAIR_THRESHOLD,
-	})
+	parsed, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+		return fmt.Errorf("%s must be a number, got %q", name, valueStr)
+	}
+	*value = parsed
+	return nil
 }
 
-func findPriceDifferences(priceLists ...[]Price) {
-	for _, symbol := range ALL_SYMBOLS {
-		var tryList []Price
+// findPriceDifferences recomputes the premiums of the given symbols, or of all symbols when symbols is nil,
+// against the reference price and publishes the result. The results of those symbols are rebuilt from scratch, so
+// quotes that went stale simply drop out.
+func findPriceDifferences(symbols []string) *marketSnapshot {
+	now := clockNow()
+	referenceFeedLive := feedConnected(GDAX)
+	if symbols == nil {
+		symbols = ALL_SYMBOLS
+	}
+
+	return market.update(func(next *marketSnapshot) {
+		implied := calculateImpliedRates(next, now, referenceFeedLive)
+		if fxSource == FX_IMPLIED {
+			for fiat, rate := range implied {
+				// Every premium of the corridor moves with its implied rate.
+				if rate.Rate != next.Implied[fiat].Rate {
+					symbols = ALL_SYMBOLS
+				}
+			}
+		}
+		next.Implied = implied
+
+		recomputed := map[string]bool{}
+		for _, symbol := range symbols {
+			recomputed[symbol] = true
+		}
+
+		for key := range next.Diffs {
+			if recomputed[keyPart(key, 2)] {
+				delete(next.Diffs, key)
+			}
+		}
+		for key := range next.Prices {
+			if recomputed[keyPart(key, 1)] {
+				delete(next.Prices, key)
+			}
+		}
+		for key := range next.LastQuotes {
+			if recomputed[keyPart(key, 1)] {
+				delete(next.LastQuotes, key)
+			}
+		}
+
+		// The EUR quotes of the reference venues take part in the EUR corridor.
+		venueQuotes := map[string][]Price{}
+		for exchange, list := range next.Quotes {
+			venueQuotes[exchange] = list
+		}
+		for exchange, list := range next.ReferenceQuotes {
+			venueQuotes[exchange] = append(venueQuotes[exchange], list...)
+		}
+
+		var exchanges []string
+		for exchange := range venueQuotes {
+			exchanges = append(exchanges, exchange)
+		}
+		sort.Strings(exchanges)
+
+		for _, symbol := range symbols {
+			quotes := referenceQuotes(next, symbol, now, referenceFeedLive)
+			composite, constituents, hasComposite := buildReferenceIndex(symbol, quotes, now)
+			delete(next.Composite, symbol)
+			delete(next.IndexConstituents, symbol)
+			delete(next.Divergences, symbol)
+			if hasComposite {
+				next.Composite[symbol] = composite
+				next.IndexConstituents[symbol] = constituents
+				if warning := referenceDivergenceWarning(symbol, quotes, composite); warning != "" {
+					next.Divergences[symbol] = warning
+				}
+			}
+
+			// Without a live reference feed the last Coinbase Pro prices are frozen, so no premium is computed from them.
+			originP, referenceStale := diffReference(next, symbol, now, referenceFeedLive)
 
-		originP := coinbaseProPrices[symbol]
-		tryP := Price{Currency: "TRY", Exchange: originP.Exchange, ID: originP.ID, Bid: originP.Bid * tryRate, Ask: originP.Ask * tryRate}
-		tryList = append(tryList, tryP)
+			fiatLists := map[string][]Price{}
+			for _, exchange := range exchanges {
+				for _, p := range venueQuotes[exchange] {
+					if p.ID != symbol || !isCorridor(p.Currency) {
+						continue
+					}
+					next.LastQuotes[fmt.Sprintf("%s-%s", p.Exchange, p.ID)] = p
 
-		for _, list := range priceLists {
-			for _, p := range list {
-				if p.ID == symbol {
-					switch p.Currency {
-					case "TRY":
-						tryList = append(tryList, p)
+					// Stale quotes, or quotes against a stale reference, must not produce diffs or alerts.
+					if referenceStale || next.diffRate(p.Currency) == 0 || p.Stale(now) {
+						continue
 					}
+					fiatLists[p.Currency] = append(fiatLists[p.Currency], p)
+				}
+			}
+
+			// Every corridor compares its venues with the reference converted at the corridor's rate.
+			for _, fiat := range corridors {
+				if len(fiatLists[fiat]) == 0 {
+					continue
 				}
+
+				rate := next.diffRate(fiat)
+				fiatP := Price{Currency: fiat, Exchange: originP.Exchange, ID: originP.ID, Bid: originP.Bid * rate, Ask: originP.Ask * rate}
+				setDiffsAndPrices(append([]Price{fiatP}, fiatLists[fiat]...), next)
 			}
 		}
 
-		/*for _, p := range tryList {
-			fmt.Println(fmt.Sprintf("ID %s Exchange %s Ask %f", p.ID, p.Exchange, p.Ask))
-		}*/
-		setDiffsAndPrices(tryList)
-	}
+		setMinMaxDiffs(next)
+	})
 }
 
-func setDiffsAndPrices(list []Price) {
+func setDiffsAndPrices(list []Price, next *marketSnapshot) {
 	firstExchange := "GDAX"
 	firstAsk := 0.0
 	for i, p := range list {
@@ -479,35 +532,52 @@ func setDiffsAndPrices(list []Price) {
 			askRound := Round(askPercentage, .5, 2)
 			bidRound := Round(bidPercentage, .5, 2)
 
-			mux.Lock()
-			diffs[fmt.Sprintf("%s-%s-%s-%s", firstExchange, p.Exchange, p.ID, "Ask")] = askRound
-			diffs[fmt.Sprintf("%s-%s-%s-%s", firstExchange, p.Exchange, p.ID, "Bid")] = bidRound
-
-			//fmt.Println(fmt.Sprintf("%s-%s-%s-%s", firstExchange, p.Exchange, p.ID, "Ask"))
-
-			prices[fmt.Sprintf("%s-%s-%s", p.Exchange, p.ID, "Ask")] = p.Ask
-			prices[fmt.Sprintf("%s-%s-%s", p.Exchange, p.ID, "Bid")] = p.Bid
-			mux.Unlock()
+			next.Diffs[fmt.Sprintf("%s-%s-%s-%s", firstExchange, p.Exchange, p.ID, "Ask")] = askRound
+			next.Diffs[fmt.Sprintf("%s-%s-%s-%s", firstExchange, p.Exchange, p.ID, "Bid")] = bidRound
 
-			maxD := maxDiffs[p.Exchange]
-			minD, ok := minDiffs[p.Exchange]
-			if !ok {
-				minD = 100
-			}
+			next.Prices[fmt.Sprintf("%s-%s-%s", p.Exchange, p.ID, "Ask")] = p.Ask
+			next.Prices[fmt.Sprintf("%s-%s-%s", p.Exchange, p.ID, "Bid")] = p.Bid
+		}
+	}
+}
 
-			if askRound < minD {
-				minDiffs[p.Exchange] = askRound
-				minSymbol[p.Exchange] = p.ID
+// setMinMaxDiffs finds, per exchange, the symbol with the lowest ask diff and the one with the highest bid diff.
+func setMinMaxDiffs(next *marketSnapshot) {
+	next.MinDiffs, next.MaxDiffs = map[string]float64{}, map[string]float64{}
+	next.MinSymbol, next.MaxSymbol = map[string]string{}, map[string]string{}
+
+	for key, diff := range next.Diffs {
+		exchange, symbol := keyPart(key, 1), keyPart(key, 2)
+		switch keyPart(key, 3) {
+		case "Ask":
+			if minD, ok := next.MinDiffs[exchange]; !ok || diff < minD {
+				next.MinDiffs[exchange] = diff
+				next.MinSymbol[exchange] = symbol
 			}
-
-			if bidRound > maxD {
-				maxDiffs[p.Exchange] = bidRound
-				maxSymbol[p.Exchange] = p.ID
+		case "Bid":
+			if maxD, ok := next.MaxDiffs[exchange]; !ok || diff > maxD {
+				next.MaxDiffs[exchange] = diff
+				next.MaxSymbol[exchange] = symbol
 			}
 		}
 	}
 }
 
+// keyPart returns the index-th dash separated part of a diff, price or quote key.
+func keyPart(key string, index int) string {
+	parts := strings.Split(key, "-")
+	if index >= len(parts) {
+		return ""
+	}
+	return parts[index]
+}
+
+// refreshReferenceDiffs recomputes every premium once the Coinbase Pro feed drops, so no diff is left computed
+// against its frozen prices.
+func refreshReferenceDiffs() {
+	emitQuoteEvent(quoteEvent{ReceivedTime: clockNow()})
+}
+
 func Round(val float64, roundOn float64, places int) (newVal float64) {
 	var round float64
 	pow := math.Pow(10, float64(places))
@@ -521,23 +591,3 @@ func Round(val float64, roundOn float64, places int) (newVal float64) {
 	newVal = round / pow
 	return
 }
-
-func resetDiffsAndSymbols() {
-	for key, _ := range minDiffs {
-		minDiffs[key] = 100
-	}
-
-	for key, _ := range maxDiffs {
-		maxDiffs[key] = -100
-	}
-
-	for key, _ := range minSymbol {
-		minSymbol[key] = ""
-	}
-
-	for key, _ := range maxSymbol {
-		maxSymbol[key] = ""
-	}
-
-	warning = ""
-}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DEFAULT_SETTINGS_FILE = "settings.json"
+	// MAX_SETTINGS_VERSIONS is how many versions are kept to roll back to.
+	MAX_SETTINGS_VERSIONS = 50
+	// SETTINGS_VERSIONS_SHOWN is how many versions the notification page lists.
+	SETTINGS_VERSIONS_SHOWN = 10
+	// SETTINGS_DEFAULT_USER is the user of the built-in defaults.
+	SETTINGS_DEFAULT_USER = "default"
+)
+
+// SettingsVersion is one saved configuration of the notification settings. A rollback saves the old settings again
+// as a new version, so the history only ever grows.
+type SettingsVersion struct {
+	Version        int                  `json:"version"`
+	Settings       NotificationSettings `json:"settings"`
+	User           string               `json:"user"`
+	Time           time.Time            `json:"time"`
+	RolledBackFrom int                  `json:"rolledBackFrom,omitempty"`
+}
+
+type settingsStore struct {
+	Versions []SettingsVersion `json:"versions"`
+}
+
+var (
+	// settingsFile keeps the notification settings across restarts, set with SETTINGS_FILE.
+	settingsFile     = DEFAULT_SETTINGS_FILE
+	settingsVersions settingsStore
+	settingsMux      sync.Mutex
+)
+
+func init() {
+	if file := os.Getenv("SETTINGS_FILE"); file != "" {
+		settingsFile = file
+	}
+}
+
+// loadNotificationSettings restores the latest saved version of the notification settings. Without a settings file
+// the defaults stay.
+func loadNotificationSettings() error {
+	data, err := ioutil.ReadFile(settingsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read settings %s : %s", settingsFile, err)
+	}
+
+	stored := settingsStore{}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("failed to parse settings %s : %s", settingsFile, err)
+	}
+
+	settingsMux.Lock()
+	defer settingsMux.Unlock()
+
+	settingsVersions = stored
+	if len(stored.Versions) > 0 {
+		latest := stored.Versions[len(stored.Versions)-1]
+		setNotificationSettings(latest.Settings)
+		configLog.Info("notification settings restored", "version", latest.Version, "user", latest.User)
+	}
+	return nil
+}
+
+// saveSettingsVersions must be called with settingsMux held.
+func saveSettingsVersions(store settingsStore) error {
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode settings : %s", err)
+	}
+
+	tmpFile := settingsFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write settings %s : %s", tmpFile, err)
+	}
+	if err := os.Rename(tmpFile, settingsFile); err != nil {
+		return fmt.Errorf("failed to replace settings %s : %s", settingsFile, err)
+	}
+	return nil
+}
+
+// saveNotificationSettings stores settings as a new version and only applies them once they are saved, so the
+// running configuration is always the one a restart comes back with.
+func saveNotificationSettings(settings NotificationSettings, user string, rolledBackFrom int) (SettingsVersion, error) {
+	settingsMux.Lock()
+	defer settingsMux.Unlock()
+
+	now := time.Now()
+	versions := append([]SettingsVersion(nil), settingsVersions.Versions...)
+	if len(versions) == 0 {
+		// The first change keeps the defaults as version 1, so they can be rolled back to.
+		versions = append(versions, SettingsVersion{
+			Version:  1,
+			Settings: currentNotificationSettings(),
+			User:     SETTINGS_DEFAULT_USER,
+			Time:     now,
+		})
+	}
+
+	version := SettingsVersion{
+		Version:        versions[len(versions)-1].Version + 1,
+		Settings:       settings,
+		User:           user,
+		Time:           now,
+		RolledBackFrom: rolledBackFrom,
+	}
+
+	next := settingsStore{Versions: append(versions, version)}
+	if overflow := len(next.Versions) - MAX_SETTINGS_VERSIONS; overflow > 0 {
+		next.Versions = next.Versions[overflow:]
+	}
+	if err := saveSettingsVersions(next); err != nil {
+		return version, err
+	}
+
+	settingsVersions = next
+	setNotificationSettings(settings)
+	return version, nil
+}
+
+func findSettingsVersion(number int) (SettingsVersion, bool) {
+	settingsMux.Lock()
+	defer settingsMux.Unlock()
+
+	for _, version := range settingsVersions.Versions {
+		if version.Version == number {
+			return version, true
+		}
+	}
+	return SettingsVersion{}, false
+}
+
+// recentSettingsVersions returns the last limit versions, newest first.
+func recentSettingsVersions(limit int) []SettingsVersion {
+	settingsMux.Lock()
+	defer settingsMux.Unlock()
+
+	var result []SettingsVersion
+	for i := len(settingsVersions.Versions) - 1; i >= 0 && len(result) < limit; i-- {
+		result = append(result, settingsVersions.Versions[i])
+	}
+	return result
+}
+
+// RollbackNotificationSettings applies the settings of an earlier version again.
+func RollbackNotificationSettings(c *gin.Context) {
+	versionStr := c.PostForm("version")
+	number, err := strconv.Atoi(versionStr)
+	if err != nil {
+		renderNotificationPage(c, http.StatusBadRequest, currentNotificationSettings(),
+			fmt.Sprintf("invalid version %q", versionStr))
+		return
+	}
+
+	previous, ok := findSettingsVersion(number)
+	if !ok {
+		renderNotificationPage(c, http.StatusNotFound, currentNotificationSettings(),
+			fmt.Sprintf("unknown version %d", number))
+		return
+	}
+
+	current := currentNotificationSettings()
+	version, err := saveNotificationSettings(previous.Settings, authUser(c), number)
+	if err != nil {
+		configLog.Error("cannot save the notification settings", "error", err)
+		renderNotificationPage(c, http.StatusInternalServerError, current, "The settings could not be saved")
+		return
+	}
+
+	details := []string{"version", strconv.Itoa(version.Version), "rolledBackFrom", versionStr}
+	details = append(details, settingsChanges(current, previous.Settings)...)
+	audit(c, authUser(c), "notification settings rolled back", details...)
+	c.Redirect(http.StatusSeeOther, "/notification")
+}
+
+// GetSettingsVersions returns every kept version of the notification settings, newest first.
+func GetSettingsVersions(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"current":  currentNotificationSettings(),
+		"versions": recentSettingsVersions(MAX_SETTINGS_VERSIONS),
+	})
+}
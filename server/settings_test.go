@@ -0,0 +1,148 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// resetSettings starts a test with the default notification settings, no versions and a settings file of its own.
+func resetSettings(t *testing.T) {
+	previousFile, previousSettings, previousAuditFile := settingsFile, currentNotificationSettings(), auditLogFile
+	settingsFile = filepath.Join(t.TempDir(), "settings.json")
+	auditLogFile = filepath.Join(t.TempDir(), "audit.log")
+	settingsMux.Lock()
+	settingsVersions = settingsStore{}
+	settingsMux.Unlock()
+	t.Cleanup(func() {
+		settingsFile, auditLogFile = previousFile, previousAuditFile
+		settingsMux.Lock()
+		settingsVersions = settingsStore{}
+		settingsMux.Unlock()
+		setNotificationSettings(previousSettings)
+	})
+}
+
+func TestSaveNotificationSettingsCapped(t *testing.T) {
+	tests := []struct {
+		name  string
+		saves int
+		first int
+		last  int
+	}{
+		{name: "first save keeps the defaults", saves: 1, first: 1, last: 2},
+		{name: "below the cap", saves: MAX_SETTINGS_VERSIONS - 1, first: 1, last: MAX_SETTINGS_VERSIONS},
+		{name: "at the cap", saves: MAX_SETTINGS_VERSIONS, first: 2, last: MAX_SETTINGS_VERSIONS + 1},
+		{name: "over the cap", saves: MAX_SETTINGS_VERSIONS + 10, first: 12, last: MAX_SETTINGS_VERSIONS + 11},
+	}
+
+	for _, test := range tests {
+		resetSettings(t)
+		defaults := currentNotificationSettings()
+		for i := 1; i <= test.saves; i++ {
+			settings := defaults
+			settings.Minimum = float64(i)
+			if _, err := saveNotificationSettings(settings, "admin", 0); err != nil {
+				t.Fatalf("%s : failed to save version %d : %s", test.name, i+1, err)
+			}
+		}
+
+		versions := recentSettingsVersions(MAX_SETTINGS_VERSIONS + 1)
+		if expected := test.last - test.first + 1; len(versions) != expected {
+			t.Errorf("%s : expected %d versions, got %d", test.name, expected, len(versions))
+			continue
+		}
+		if versions[0].Version != test.last || versions[len(versions)-1].Version != test.first {
+			t.Errorf("%s : expected versions %d to %d, got %d to %d", test.name, test.first, test.last,
+				versions[len(versions)-1].Version, versions[0].Version)
+		}
+		if current := currentNotificationSettings(); current.Minimum != float64(test.saves) {
+			t.Errorf("%s : expected the last save to apply, got minimum %v", test.name, current.Minimum)
+		}
+
+		// A restart comes back with the same versions and settings.
+		saved := currentNotificationSettings()
+		setNotificationSettings(defaults)
+		if err := loadNotificationSettings(); err != nil {
+			t.Fatalf("%s : failed to load the settings : %s", test.name, err)
+		}
+		if current := currentNotificationSettings(); current != saved {
+			t.Errorf("%s : expected %+v after loading, got %+v", test.name, saved, current)
+		}
+		if loaded := recentSettingsVersions(MAX_SETTINGS_VERSIONS + 1); len(loaded) != len(versions) {
+			t.Errorf("%s : expected %d versions after loading, got %d", test.name, len(versions), len(loaded))
+		}
+	}
+}
+
+func TestRollbackNotificationSettings(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.LoadHTMLGlob("../templates/*")
+	router.POST("/notification/rollback", func(c *gin.Context) {
+		c.Set(AUTH_USER, "admin")
+		RollbackNotificationSettings(c)
+	})
+
+	tests := []struct {
+		name    string
+		version string
+		code    int
+		// minimum is the Minimum of the settings after the request, rolledBackFrom of the new version if any.
+		minimum        float64
+		rolledBackFrom int
+	}{
+		{name: "earlier version", version: "3", code: http.StatusSeeOther, minimum: 2, rolledBackFrom: 3},
+		{name: "defaults", version: "1", code: http.StatusSeeOther, minimum: MIN_NOTI_PERC, rolledBackFrom: 1},
+		{name: "current version", version: "6", code: http.StatusSeeOther, minimum: 5, rolledBackFrom: 6},
+		{name: "unknown version", version: "7", code: http.StatusNotFound, minimum: 5},
+		{name: "version zero", version: "0", code: http.StatusNotFound, minimum: 5},
+		{name: "invalid version", version: "latest", code: http.StatusBadRequest, minimum: 5},
+		{name: "no version", code: http.StatusBadRequest, minimum: 5},
+	}
+
+	for _, test := range tests {
+		resetSettings(t)
+		defaults := currentNotificationSettings()
+		defaults.Minimum = MIN_NOTI_PERC
+		setNotificationSettings(defaults)
+		// Versions 2 to 6 have the minimums 1 to 5 on top of the defaults as version 1.
+		for i := 1; i <= 5; i++ {
+			settings := defaults
+			settings.Minimum = float64(i)
+			if _, err := saveNotificationSettings(settings, "admin", 0); err != nil {
+				t.Fatalf("%s : failed to save version %d : %s", test.name, i+1, err)
+			}
+		}
+
+		form := url.Values{"version": {test.version}}
+		req := httptest.NewRequest(http.MethodPost, "/notification/rollback", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != test.code {
+			t.Errorf("%s : expected %d, got %d", test.name, test.code, w.Code)
+		}
+		if current := currentNotificationSettings(); current.Minimum != test.minimum {
+			t.Errorf("%s : expected minimum %v, got %v", test.name, test.minimum, current.Minimum)
+		}
+
+		latest := recentSettingsVersions(1)[0]
+		if test.rolledBackFrom == 0 {
+			if latest.Version != 6 {
+				t.Errorf("%s : expected no new version, got version %d", test.name, latest.Version)
+			}
+			continue
+		}
+		if latest.Version != 7 || latest.RolledBackFrom != test.rolledBackFrom || latest.User != "admin" {
+			t.Errorf("%s : expected version 7 rolled back from %d by admin, got %+v", test.name,
+				test.rolledBackFrom, latest)
+		}
+	}
+}
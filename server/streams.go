@@ -0,0 +1,340 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+	ws "github.com/gorilla/websocket"
+)
+
+const (
+	BINANCE_WS_URI = "wss://stream.binance.com:9443/stream?streams=%s"
+	BTCTURK_WS_URI = "wss://ws-feed-pro.btcturk.com/"
+	PARIBU_WS_URI  = "wss://stream.paribu.com/ws"
+
+	BINANCE_SILENCE_TIMEOUT = 1 * time.Minute
+	BTCTURK_SILENCE_TIMEOUT = 1 * time.Minute
+	PARIBU_SILENCE_TIMEOUT  = 1 * time.Minute
+
+	BTCTURK_SUBSCRIBE   = 151
+	BTCTURK_TICKER_ALL  = 401
+	BTCTURK_TICKER_PAIR = 402
+)
+
+// streamBook is the best bid and ask per symbol a streaming adapter keeps for its current connection. Venues only
+// push changes, so every quote in the book is confirmed again by each frame received on the live connection and
+// is published with that frame's receive time. The book is reseeded on every reconnect so quotes from a previous
+// connection are never re-stamped.
+type streamBook struct {
+	exchange string
+	// publishFn hands the book to the market, publishQuotes for TRY venues.
+	publishFn func(exchange string, list []Price, symbols []string, receivedTime time.Time)
+
+	mu     sync.Mutex
+	prices map[string]Price
+}
+
+func newStreamBook(exchange string, publishFn func(string, []Price, []string, time.Time)) *streamBook {
+	return &streamBook{exchange: exchange, publishFn: publishFn, prices: map[string]Price{}}
+}
+
+// bookKey tells the markets of a symbol in different currencies apart.
+func bookKey(p Price) string {
+	return p.ID + "-" + p.Currency
+}
+
+// reset replaces the book with a REST snapshot taken right after subscribing. The snapshot is validated like the
+// frames, a rejected quote is left out of the book.
+func (b *streamBook) reset(seed []Price) {
+	seed = validateQuotes(b.exchange, seed)
+
+	b.mu.Lock()
+	b.prices = map[string]Price{}
+	for _, p := range seed {
+		b.prices[bookKey(p)] = p
+	}
+	b.mu.Unlock()
+}
+
+func (b *streamBook) set(p Price) {
+	// A rejected quote also removes the previous one of the pair, like a REST poll that leaves it out.
+	if !acceptQuote(b.exchange, p, clockNow()) {
+		b.mu.Lock()
+		delete(b.prices, bookKey(p))
+		b.mu.Unlock()
+		return
+	}
+
+	b.mu.Lock()
+	// Book channels carry no volume, the last one known is kept for the reference index.
+	if previous, ok := b.prices[bookKey(p)]; ok && p.Volume == 0 {
+		p.Volume = previous.Volume
+	}
+	b.prices[bookKey(p)] = p
+	b.mu.Unlock()
+}
+
+// publish hands the whole book to the market and schedules the recalculation of the symbols the frame changed.
+func (b *streamBook) publish(receivedTime time.Time, symbols []string) {
+	b.mu.Lock()
+	list := make([]Price, 0, len(b.prices))
+	for _, p := range b.prices {
+		p.ReceivedTime = receivedTime
+		list = append(list, p)
+	}
+	b.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return bookKey(list[i]) < bookKey(list[j]) })
+	if symbols == nil {
+		// Nothing tracked changed, only the receive times are refreshed.
+		symbols = []string{}
+	}
+	b.publishFn(b.exchange, list, symbols, receivedTime)
+}
+
+// seedStreamBook fills the book from the REST adapter. A failed seed is only logged, the book then fills up as
+// the venue pushes updates.
+func seedStreamBook(book *streamBook, getPrices func() ([]Price, error)) {
+	seed, err := getPrices()
+	if err != nil {
+		feedLog.Warn("cannot seed the stream from REST", "exchange", book.exchange, "error", err)
+	}
+	book.reset(seed)
+}
+
+var (
+	binanceBook = newStreamBook(BINANCE, publishQuotes)
+	btcTurkBook = newStreamBook(BTCTURK, publishQuotes)
+	paribuBook  = newStreamBook(PARIBU, publishQuotes)
+)
+
+// startBinanceWS streams bookTicker updates of every configured TRY pair over a single combined stream. While it
+// is connected calculatePrices skips the Binance REST poll, which takes over again as soon as the stream drops.
+func startBinanceWS(ctx context.Context) {
+	var streams []string
+	for _, currency := range binanceCurrencies {
+		streams = append(streams, strings.ToLower(currency+"TRY")+"@bookTicker")
+	}
+
+	feed := registerFeed(&wsFeed{
+		name:           BINANCE,
+		uri:            fmt.Sprintf(BINANCE_WS_URI, strings.Join(streams, "/")),
+		silenceTimeout: BINANCE_SILENCE_TIMEOUT,
+		subscribe:      subscribeBinance,
+		handle:         handleBinanceMessage,
+	})
+	feed.run(ctx)
+}
+
+// subscribeBinance has nothing to send, the combined stream URI already names the streams.
+func subscribeBinance(conn *ws.Conn) error {
+	seedStreamBook(binanceBook, getBinancePrices)
+	return nil
+}
+
+func handleBinanceMessage(data []byte) error {
+	receivedTime := clockNow()
+
+	symbol, err := jsonparser.GetString(data, "data", "s")
+	if err != nil {
+		return fmt.Errorf("failed to read the symbol from the Binance stream data : %s", err)
+	}
+	if !strings.HasSuffix(symbol, "TRY") {
+		return nil
+	}
+
+	priceAsk, err := jsonparser.GetString(data, "data", "a")
+	if err != nil {
+		return fmt.Errorf("failed to read the ask price from the Binance stream data: %s", err)
+	}
+	priceBid, err := jsonparser.GetString(data, "data", "b")
+	if err != nil {
+		return fmt.Errorf("failed to read the bid price from the Binance stream data: %s", err)
+	}
+
+	id := strings.TrimSuffix(symbol, "TRY")
+	pAsk, errAsk := strconv.ParseFloat(priceAsk, 64)
+	pBid, errBid := strconv.ParseFloat(priceBid, 64)
+	if errAsk != nil || errBid != nil {
+		// A malformed ticker is dropped, it is no reason to reconnect.
+		recordIncident(BINANCE, fmt.Sprintf("%s TRY %q / %q", id, priceAsk, priceBid), REJECT_UNPARSEABLE, receivedTime)
+		return nil
+	}
+	binanceBook.set(Price{Exchange: BINANCE, Currency: "TRY", ID: id, Ask: pAsk, Bid: pBid})
+	binanceBook.publish(receivedTime, []string{id})
+	return nil
+}
+
+// startBTCTurkWS streams BTCTurk's ticker channel, which carries the best bid and ask of every pair. While it is
+// connected calculatePrices skips the BTCTurk REST poll.
+func startBTCTurkWS(ctx context.Context) {
+	feed := registerFeed(&wsFeed{
+		name:           BTCTURK,
+		uri:            BTCTURK_WS_URI,
+		silenceTimeout: BTCTURK_SILENCE_TIMEOUT,
+		subscribe:      subscribeBTCTurk,
+		handle:         handleBTCTurkMessage,
+	})
+	feed.run(ctx)
+}
+
+func subscribeBTCTurk(conn *ws.Conn) error {
+	seedStreamBook(btcTurkBook, getBTCTurkPrices)
+
+	subscribe := []interface{}{
+		BTCTURK_SUBSCRIBE,
+		map[string]interface{}{"type": BTCTURK_SUBSCRIBE, "channel": "ticker", "event": "all", "join": true},
+	}
+	return conn.WriteJSON(subscribe)
+}
+
+// handleBTCTurkMessage reads the [type, payload] frames of BTCTurk. Every type other than the tickers, such as
+// the connection and subscription results, is ignored.
+func handleBTCTurkMessage(data []byte) error {
+	receivedTime := clockNow()
+
+	messageType, err := jsonparser.GetInt(data, "[0]")
+	if err != nil {
+		return fmt.Errorf("failed to read the BTCTurk message type : %s", err)
+	}
+
+	var returnError error
+	var symbols []string
+	switch messageType {
+	case BTCTURK_TICKER_ALL:
+		jsonparser.ArrayEach(data, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+			pair, err := setBTCTurkTicker(value)
+			if err != nil {
+				returnError = err
+			} else if pair != "" {
+				symbols = append(symbols, pair)
+			}
+		}, "[1]", "items")
+	case BTCTURK_TICKER_PAIR:
+		payload, _, _, err := jsonparser.Get(data, "[1]")
+		if err != nil {
+			return fmt.Errorf("failed to read the BTCTurk ticker payload : %s", err)
+		}
+		pair, err := setBTCTurkTicker(payload)
+		if pair != "" {
+			symbols = append(symbols, pair)
+		}
+		returnError = err
+	default:
+		return nil
+	}
+
+	if returnError != nil {
+		return returnError
+	}
+	btcTurkBook.publish(receivedTime, symbols)
+	return nil
+}
+
+// setBTCTurkTicker stores a ticker in the book and returns its symbol, or "" when the pair is not tracked.
+func setBTCTurkTicker(value []byte) (string, error) {
+	pairName, err := jsonparser.GetString(value, "PS")
+	if err != nil {
+		return "", fmt.Errorf("failed to read BTCTurk pairname from the stream data : %s", err)
+	}
+
+	pair, ok := btcTurkSymbol(pairName)
+	if !ok {
+		return "", nil
+	}
+
+	pAsk, err := getJSONFloat(value, "A")
+	if err != nil {
+		return "", fmt.Errorf("failed to read the %s ask price from the BTCTurk stream data: %s", pair, err)
+	}
+
+	pBid, err := getJSONFloat(value, "B")
+	if err != nil {
+		return "", fmt.Errorf("failed to read the %s bid price from the BTCTurk stream data: %s", pair, err)
+	}
+
+	btcTurkBook.set(Price{Exchange: BTCTURK, Currency: "TRY", ID: pair, Ask: pAsk, Bid: pBid})
+	return pair, nil
+}
+
+// startParibuWS streams Paribu's ticker channel. Its frames carry the same per-market lowestAsk/highestBid
+// objects as the REST ticker, but only for the markets that changed. While it is connected calculatePrices skips
+// the Paribu REST poll.
+func startParibuWS(ctx context.Context) {
+	feed := registerFeed(&wsFeed{
+		name:           PARIBU,
+		uri:            PARIBU_WS_URI,
+		silenceTimeout: PARIBU_SILENCE_TIMEOUT,
+		subscribe:      subscribeParibu,
+		handle:         handleParibuMessage,
+	})
+	feed.run(ctx)
+}
+
+func subscribeParibu(conn *ws.Conn) error {
+	seedStreamBook(paribuBook, getParibuPrices)
+
+	subscribe := map[string]interface{}{"event": "subscribe", "channel": "ticker"}
+	return conn.WriteJSON(subscribe)
+}
+
+func handleParibuMessage(data []byte) error {
+	receivedTime := clockNow()
+
+	channel, _ := jsonparser.GetString(data, "channel")
+	if channel != "ticker" {
+		return nil
+	}
+
+	tracked := map[string]bool{}
+	for _, id := range paribuCurrencies {
+		tracked[id] = true
+	}
+
+	var symbols []string
+	err := jsonparser.ObjectEach(data, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		marketName := string(key)
+		id := strings.TrimSuffix(marketName, "_TL")
+		if id == marketName || !tracked[id] {
+			return nil
+		}
+
+		priceAsk, err := getJSONFloat(value, "lowestAsk")
+		if err != nil {
+			return fmt.Errorf("failed to read the %s ask price from the Paribu stream data: %s", id, err)
+		}
+
+		priceBid, err := getJSONFloat(value, "highestBid")
+		if err != nil {
+			return fmt.Errorf("failed to read the %s bid price from the Paribu stream data: %s", id, err)
+		}
+
+		paribuBook.set(Price{Exchange: PARIBU, Currency: "TRY", ID: id, Ask: priceAsk, Bid: priceBid})
+		symbols = append(symbols, id)
+		return nil
+	}, "data")
+	if err != nil {
+		return err
+	}
+
+	paribuBook.publish(receivedTime, symbols)
+	return nil
+}
+
+// getJSONFloat reads a number that venues send either as a JSON number or as a string.
+func getJSONFloat(data []byte, keys ...string) (float64, error) {
+	value, dataType, _, err := jsonparser.Get(data, keys...)
+	if err != nil {
+		return 0, err
+	}
+	if dataType != jsonparser.Number && dataType != jsonparser.String {
+		return 0, fmt.Errorf("unexpected %s value", dataType)
+	}
+	return strconv.ParseFloat(string(value), 64)
+}
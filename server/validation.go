@@ -0,0 +1,176 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	REJECT_ZERO    = "zero"
+	REJECT_NAN     = "not a number"
+	REJECT_CROSSED = "crossed"
+	REJECT_JUMP    = "jump"
+	// REJECT_UNPARSEABLE is recorded by the feeds for prices that are not numbers at all.
+	REJECT_UNPARSEABLE = "unparseable"
+
+	DEFAULT_MAX_QUOTE_JUMP = 20.0
+	// JUMP_CONFIRMATIONS consecutive quotes at the new level accept a jump, a genuine move is not rejected for ever.
+	JUMP_CONFIRMATIONS = 3
+)
+
+var (
+	// maxQuoteJump is how far, in percent, a quote's mid may move from the last accepted mid of the same source before
+	// it is rejected as implausible. It is set with MAX_QUOTE_JUMP.
+	maxQuoteJump = DEFAULT_MAX_QUOTE_JUMP
+
+	validQuotes   = map[string]Price{}
+	pendingJumps  = map[string]pendingJump{}
+	qualityStats  = map[string]*QualityStatus{}
+	validationMux sync.Mutex
+)
+
+func init() {
+	if value := os.Getenv("MAX_QUOTE_JUMP"); value != "" {
+		percent, err := strconv.ParseFloat(value, 64)
+		if err != nil || percent <= 0 {
+			configLog.Warn("invalid setting", "name", "MAX_QUOTE_JUMP", "value", value)
+		} else {
+			maxQuoteJump = percent
+		}
+	}
+}
+
+// QualityStatus counts the data-quality incidents of an exchange, the quotes its feeds delivered that were rejected.
+type QualityStatus struct {
+	Exchange   string         `json:"exchange"`
+	Incidents  map[string]int `json:"incidents"`
+	Total      int            `json:"total"`
+	LastReason string         `json:"lastReason"`
+	LastTime   time.Time      `json:"lastTime"`
+}
+
+type pendingJump struct {
+	Mid   float64
+	Count int
+}
+
+func quoteKey(p Price) string {
+	return fmt.Sprintf("%s-%s-%s", p.Exchange, p.Currency, p.ID)
+}
+
+// validateQuote returns why a quote must not be used, or "" when it is sane. Quotes with a zero or non-finite price
+// and crossed books are rejected outright. A quote whose mid moved more than maxQuoteJump from the last accepted one
+// of the same source is held back until JUMP_CONFIRMATIONS quotes in a row confirm the new level, or the last
+// accepted quote is stale anyway.
+func validateQuote(p Price, now time.Time) string {
+	switch {
+	case math.IsNaN(p.Ask) || math.IsNaN(p.Bid) || math.IsInf(p.Ask, 0) || math.IsInf(p.Bid, 0):
+		return REJECT_NAN
+	case p.Ask <= 0 || p.Bid <= 0:
+		return REJECT_ZERO
+	case p.Bid > p.Ask:
+		return REJECT_CROSSED
+	}
+
+	key := quoteKey(p)
+	mid := (p.Ask + p.Bid) / 2
+
+	validationMux.Lock()
+	defer validationMux.Unlock()
+
+	last, ok := validQuotes[key]
+	if ok && !last.Stale(now) {
+		lastMid := (last.Ask + last.Bid) / 2
+		if math.Abs(mid-lastMid)*100/lastMid > maxQuoteJump {
+			pending := pendingJumps[key]
+			if pending.Count == 0 || math.Abs(mid-pending.Mid)*100/pending.Mid > maxQuoteJump {
+				pending = pendingJump{Mid: mid}
+			}
+			pending.Count++
+			if pending.Count < JUMP_CONFIRMATIONS {
+				pendingJumps[key] = pending
+				return REJECT_JUMP
+			}
+		}
+	}
+
+	delete(pendingJumps, key)
+	if p.ReceivedTime.IsZero() {
+		p.ReceivedTime = now
+	}
+	validQuotes[key] = p
+	return ""
+}
+
+// validateQuotes drops the quotes of a list that fail validateQuote and records every rejection as an incident of
+// the exchange.
+func validateQuotes(exchange string, list []Price) []Price {
+	now := clockNow()
+	valid := make([]Price, 0, len(list))
+	for _, p := range list {
+		if !acceptQuote(exchange, p, now) {
+			continue
+		}
+		valid = append(valid, p)
+	}
+	return valid
+}
+
+// acceptQuote validates a single quote and records the incident when it is rejected.
+func acceptQuote(exchange string, p Price, now time.Time) bool {
+	reason := validateQuote(p, now)
+	if reason == "" {
+		return true
+	}
+	recordIncident(exchange, fmt.Sprintf("%s %s", p.ID, p.Currency), reason, now)
+	return false
+}
+
+// recordIncident counts a data-quality incident of an exchange.
+func recordIncident(exchange, subject, reason string, now time.Time) {
+	validationMux.Lock()
+	status, ok := qualityStats[exchange]
+	if !ok {
+		status = &QualityStatus{Exchange: exchange, Incidents: map[string]int{}}
+		qualityStats[exchange] = status
+	}
+	status.Incidents[reason]++
+	status.Total++
+	status.LastReason = fmt.Sprintf("%s : %s", subject, reason)
+	status.LastTime = now
+	validationMux.Unlock()
+
+	validationLog.Info("quote rejected", "exchange", exchange, "quote", subject, "reason", reason)
+}
+
+func qualityStatuses() []QualityStatus {
+	validationMux.Lock()
+	defer validationMux.Unlock()
+
+	var statuses []QualityStatus
+	for _, status := range qualityStats {
+		copied := *status
+		copied.Incidents = make(map[string]int, len(status.Incidents))
+		for reason, count := range status.Incidents {
+			copied.Incidents[reason] = count
+		}
+		statuses = append(statuses, copied)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Exchange < statuses[j].Exchange })
+	return statuses
+}
+
+func GetQuality(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"maxQuoteJump": maxQuoteJump,
+		"exchanges":    qualityStatuses(),
+	})
+}
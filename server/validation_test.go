@@ -0,0 +1,106 @@
+package server
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// resetValidation starts a test with no accepted quotes and no incidents.
+func resetValidation(t *testing.T) {
+	validationMux.Lock()
+	validQuotes, pendingJumps, qualityStats = map[string]Price{}, map[string]pendingJump{}, map[string]*QualityStatus{}
+	validationMux.Unlock()
+	t.Cleanup(func() {
+		validationMux.Lock()
+		validQuotes, pendingJumps, qualityStats = map[string]Price{}, map[string]pendingJump{}, map[string]*QualityStatus{}
+		validationMux.Unlock()
+	})
+}
+
+func TestValidateQuote(t *testing.T) {
+	resetValidation(t)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	quote := func(ask, bid float64) Price {
+		return Price{Exchange: PARIBU, Currency: "TRY", ID: "BTC", Ask: ask, Bid: bid, ReceivedTime: now}
+	}
+
+	tests := []struct {
+		name   string
+		quote  Price
+		reason string
+	}{
+		{name: "zero ask", quote: quote(0, 100), reason: REJECT_ZERO},
+		{name: "negative bid", quote: quote(100, -1), reason: REJECT_ZERO},
+		{name: "not a number", quote: quote(math.NaN(), 100), reason: REJECT_NAN},
+		{name: "infinite", quote: quote(math.Inf(1), 100), reason: REJECT_NAN},
+		{name: "crossed", quote: quote(100, 101), reason: REJECT_CROSSED},
+		{name: "first quote", quote: quote(101, 100)},
+		{name: "small move", quote: quote(105, 104)},
+		{name: "jump", quote: quote(202, 200), reason: REJECT_JUMP},
+		{name: "jump confirmed once", quote: quote(203, 201), reason: REJECT_JUMP},
+		{name: "jump confirmed", quote: quote(202, 200)},
+		{name: "move from the new level", quote: quote(204, 202)},
+	}
+
+	for _, test := range tests {
+		if reason := validateQuote(test.quote, now); reason != test.reason {
+			t.Errorf("%s : expected %q, got %q", test.name, test.reason, reason)
+		}
+	}
+}
+
+// TestValidateQuoteStaleJump checks that a jump from a quote that is stale anyway is accepted at once.
+func TestValidateQuoteStaleJump(t *testing.T) {
+	resetValidation(t)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	old := Price{Exchange: PARIBU, Currency: "TRY", ID: "BTC", Ask: 101, Bid: 100, ReceivedTime: now}
+	if reason := validateQuote(old, now); reason != "" {
+		t.Fatalf("expected the first quote to be accepted, got %q", reason)
+	}
+
+	later := now.Add(maxQuoteAge(PARIBU) + time.Second)
+	jumped := Price{Exchange: PARIBU, Currency: "TRY", ID: "BTC", Ask: 202, Bid: 200, ReceivedTime: later}
+	if reason := validateQuote(jumped, later); reason != "" {
+		t.Errorf("expected a jump from a stale quote to be accepted, got %q", reason)
+	}
+}
+
+// TestValidateQuotes checks that rejected quotes are dropped from a list and counted as incidents of the exchange.
+func TestValidateQuotes(t *testing.T) {
+	resetValidation(t)
+	list := []Price{
+		{Exchange: BTCTURK, Currency: "TRY", ID: "BTC", Ask: 101, Bid: 100},
+		{Exchange: BTCTURK, Currency: "TRY", ID: "ETH", Ask: 10, Bid: 11},
+		{Exchange: BTCTURK, Currency: "TRY", ID: "LTC", Ask: 0, Bid: 0},
+	}
+
+	valid := validateQuotes(BTCTURK, list)
+	if len(valid) != 1 || valid[0].ID != "BTC" {
+		t.Fatalf("expected only the BTC quote to be valid, got %+v", valid)
+	}
+
+	statuses := qualityStatuses()
+	if len(statuses) != 1 || statuses[0].Exchange != BTCTURK || statuses[0].Total != 2 {
+		t.Fatalf("expected 2 incidents of %s, got %+v", BTCTURK, statuses)
+	}
+	if statuses[0].Incidents[REJECT_CROSSED] != 1 || statuses[0].Incidents[REJECT_ZERO] != 1 {
+		t.Errorf("expected a crossed and a zero incident, got %v", statuses[0].Incidents)
+	}
+}
+
+// TestStreamBookSeed checks that the REST seed of a stream book is validated like its frames.
+func TestStreamBookSeed(t *testing.T) {
+	resetValidation(t)
+	book := newStreamBook(BINANCE, nil)
+	book.reset([]Price{
+		{Exchange: BINANCE, Currency: "TRY", ID: "BTC", Ask: 101, Bid: 100},
+		{Exchange: BINANCE, Currency: "TRY", ID: "ETH", Ask: 10, Bid: 11},
+	})
+
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	if _, ok := book.prices["ETH-TRY"]; ok || len(book.prices) != 1 {
+		t.Errorf("expected the crossed ETH seed to be left out, got %+v", book.prices)
+	}
+}